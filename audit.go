@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultAuditLimit = 100
+
+// AuditEntry is one administrative change, stored as a line of JSON in the
+// audit log. Before and After hold masked views of the changed item.
+type AuditEntry struct {
+	Time       time.Time      `json:"time"`
+	Actor      string         `json:"actor"`
+	Action     string         `json:"action"`
+	Resource   string         `json:"resource"`
+	RemoteAddr string         `json:"remote_addr"`
+	Before     interface{}    `json:"before,omitempty"`
+	After      interface{}    `json:"after,omitempty"`
+	Changes    []ConfigChange `json:"changes,omitempty"`
+}
+
+// ConfigChange is a single difference between two versions of a value.
+type ConfigChange struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+var auditMutex sync.Mutex
+
+// auditLogFile returns the configured audit log, by default audit.log next to the config file.
+func auditLogFile() string {
+	cMutex.RLock()
+	file := Config.AuditLog
+	cMutex.RUnlock()
+
+	if file == "" {
+		file = filepath.Join(filepath.Dir(ConfigFile), "audit.log")
+	}
+	return file
+}
+
+// auditActor names the caller of r for the audit log.
+func auditActor(r *http.Request) string {
+	if caller := callerFromContext(r.Context()); caller != nil {
+		return caller.Name
+	}
+	return "anonymous"
+}
+
+// recordAudit appends an entry to the audit log. before and after must not
+// contain secrets, use the SafeForLogging views. Failures are logged but don't
+// fail the request, the change has already been applied at this point.
+func recordAudit(r *http.Request, actor string, action string, resource string, before interface{}, after interface{}) {
+	writeAudit(AuditEntry{
+		Time:       time.Now().UTC(),
+		Actor:      actor,
+		Action:     action,
+		Resource:   resource,
+		RemoteAddr: r.RemoteAddr,
+		Before:     before,
+		After:      after,
+		Changes:    diffConfig(before, after),
+	})
+}
+
+// recordConfigAudit is recordAudit for changes of the whole configuration,
+// only the changed paths are stored.
+func recordConfigAudit(r *http.Request, action string, before SafeConfiguration, after SafeConfiguration) {
+	writeAudit(AuditEntry{
+		Time:       time.Now().UTC(),
+		Actor:      auditActor(r),
+		Action:     action,
+		Resource:   "config",
+		RemoteAddr: r.RemoteAddr,
+		Changes:    diffConfig(before, after),
+	})
+}
+
+func writeAudit(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Failed to encode audit entry")
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.OpenFile(auditLogFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Failed to open audit log")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Failed to write audit log")
+	}
+}
+
+// AuditGet returns audit entries, newest first. They can be filtered by the
+// query parameters actor, action, resource and since (unix timestamp), limit
+// caps the number of entries returned.
+func AuditGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := DefaultAuditLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid limit", err)
+			return
+		}
+	}
+
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid since", err)
+			return
+		}
+		since = time.Unix(ts, 0)
+	}
+
+	auditMutex.Lock()
+	entries, err := readAuditLog(auditLogFile())
+	auditMutex.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure reading audit log", err)
+		return
+	}
+
+	result := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		e := entries[i]
+		if (query.Get("actor") != "" && e.Actor != query.Get("actor")) ||
+			(query.Get("action") != "" && e.Action != query.Get("action")) ||
+			(query.Get("resource") != "" && e.Resource != query.Get("resource")) ||
+			e.Time.Before(since) {
+			continue
+		}
+		result = append(result, e)
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func readAuditLog(file string) ([]AuditEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warn("Skipping malformed audit entry")
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// diffConfig compares the JSON representations of before and after and
+// returns the changed paths, sorted by path.
+func diffConfig(before interface{}, after interface{}) []ConfigChange {
+	flatBefore := map[string]interface{}{}
+	flatAfter := map[string]interface{}{}
+	flattenJSON("", normalizeJSON(before), flatBefore)
+	flattenJSON("", normalizeJSON(after), flatAfter)
+
+	// a missing path and a null value are the same
+	var changes []ConfigChange
+	for path, b := range flatBefore {
+		if a := flatAfter[path]; !reflect.DeepEqual(a, b) {
+			changes = append(changes, ConfigChange{Path: path, Before: b, After: a})
+		}
+	}
+	for path, a := range flatAfter {
+		if _, found := flatBefore[path]; !found && a != nil {
+			changes = append(changes, ConfigChange{Path: path, Before: nil, After: a})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// normalizeJSON round-trips v through JSON, so structs and maps compare alike.
+func normalizeJSON(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	var out interface{}
+	_ = json.Unmarshal(data, &out)
+	return out
+}
+
+// flattenJSON flattens nested maps into dotted paths. Lists are kept as values.
+func flattenJSON(prefix string, v interface{}, out map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		if v != nil || prefix != "" {
+			out[prefix] = v
+		}
+		return
+	}
+	for k, child := range m {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		flattenJSON(path, child, out)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	before := Satellite{Name: "sat", Active: true, Targets: []string{"a"}, SecretHash: "hash1"}.SafeForLogging()
+
+	tests := []struct {
+		name     string
+		before   interface{}
+		after    interface{}
+		expected []string
+	}{
+		{"unchanged", before, before, nil},
+		{"created", nil, before, []string{"active", "certificate_auth", "last_secret_used", "name", "require_signature", "rotation_pending", "secret_fingerprint", "targets"}},
+		{"deactivated", before, Satellite{Name: "sat", Targets: []string{"a"}, SecretHash: "hash1"}.SafeForLogging(), []string{"active"}},
+		{"new secret", before, Satellite{Name: "sat", Active: true, Targets: []string{"a"}, SecretHash: "hash2"}.SafeForLogging(), []string{"secret_fingerprint"}},
+		{"nested", map[string]interface{}{"a": map[string]int{"b": 1}}, map[string]interface{}{"a": map[string]int{"b": 2, "c": 3}}, []string{"a.b", "a.c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for _, c := range diffConfig(tt.before, tt.after) {
+				paths = append(paths, c.Path)
+			}
+
+			if strings.Join(paths, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("diffConfig() = %v, want %v", paths, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	cMutex.Lock()
+	Config = Configuration{AuditLog: filepath.Join(t.TempDir(), "audit.log")}
+	cMutex.Unlock()
+
+	r := httptest.NewRequest("PUT", "/satellites/sat", nil)
+	sat := Satellite{Name: "sat", SecretHash: "hash"}
+	recordAudit(r, "alice", "satellite.create", "satellites/sat", nil, sat.SafeForLogging())
+	sat.Active = true
+	recordAudit(r, "bob", "satellite.update", "satellites/sat", Satellite{Name: "sat", SecretHash: "hash"}.SafeForLogging(), sat.SafeForLogging())
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"all newest first", "", []string{"satellite.update", "satellite.create"}},
+		{"by actor", "?actor=alice", []string{"satellite.create"}},
+		{"by action", "?action=satellite.update", []string{"satellite.update"}},
+		{"limit", "?limit=1", []string{"satellite.update"}},
+		{"unknown resource", "?resource=satellites/other", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			AuditGet(w, httptest.NewRequest("GET", "/audit"+tt.query, nil))
+
+			var entries []AuditEntry
+			if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+
+			var actions []string
+			for _, e := range entries {
+				actions = append(actions, e.Action)
+			}
+			if strings.Join(actions, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("actions = %v, want %v", actions, tt.expected)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	AuditGet(w, httptest.NewRequest("GET", "/audit?limit=1", nil))
+	if strings.Contains(w.Body.String(), `"hash"`) {
+		t.Errorf("audit log leaks secret hash: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Credentials a satellite can authenticate with, as recorded in Satellite.LastSecretUsed.
+const (
+	CredentialCertificate    = "certificate"
+	CredentialSecret         = "current"
+	CredentialPreviousSecret = "previous"
+)
+
+// authenticateSatellite verifies that r was sent by satellite and returns the
+// credential that was used. Depending on CertificateAuth a verified client
+// certificate either replaces or supplements the secret. Signed requests are
+// checked against the stored signing key, satellites with RequireSignature
+// only get these. All other requests have to carry a secret matching the
+// stored hash in the authorization header. During a secret rotation the
+// previous secret is accepted until its grace period ends.
+func authenticateSatellite(r *http.Request, satellite Satellite) (string, error) {
+	switch satellite.CertificateAuth {
+	case CertificateAuthSufficient:
+		if satelliteCertificateMatches(r, satellite) {
+			return CredentialCertificate, nil
+		}
+	case CertificateAuthRequired:
+		if !satelliteCertificateMatches(r, satellite) {
+			return "", errors.New("no valid client certificate for satellite")
+		}
+	}
+
+	previousValid := satellite.PreviousSecretHash != "" &&
+		time.Now().Unix() < satellite.PreviousSecretExpires
+
+	if r.Header.Get(HeaderNprobeSignature) != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		// restore the body for the handler
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if satellite.SigningKey == "" {
+			return "", errors.New("satellite has no signing key, set its secret again to derive one")
+		}
+		key, err := openHeadSecret(satellite.SigningKey)
+		if err != nil {
+			return "", fmt.Errorf("opening signing key: %w", err)
+		}
+
+		credential := CredentialSecret
+		nonce, err := VerifyRequestSignature(r, key, body, time.Now())
+		if err != nil && previousValid {
+			if previousKey, keyErr := openHeadSecret(satellite.PreviousSigningKey); keyErr == nil {
+				if previousNonce, previousErr := VerifyRequestSignature(r, previousKey, body, time.Now()); previousErr == nil {
+					nonce, err, credential = previousNonce, nil, CredentialPreviousSecret
+				}
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if !usedNonces.Use(satellite.Name+":"+nonce, time.Now()) {
+			return "", errors.New("nonce has already been used")
+		}
+		return credential, nil
+	}
+
+	if satellite.RequireSignature {
+		return "", errors.New("satellite requires signed requests")
+	}
+
+	secret := r.Header.Get(HeaderAuthorization)
+	if VerifySecret(secret, satellite.SecretHash) {
+		return CredentialSecret, nil
+	}
+	if previousValid && VerifySecret(secret, satellite.PreviousSecretHash) {
+		return CredentialPreviousSecret, nil
+	}
+
+	return "", errors.New("secret mismatch")
+}
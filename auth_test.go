@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func requestWithCertificate(cn string, dnsNames ...string) *http.Request {
+	r, _ := http.NewRequest("GET", "https://head/satellites/sat1/targets", nil)
+	if cn != "" || len(dnsNames) > 0 {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return r
+}
+
+func satelliteWithSecret(secret string, certificateAuth string, certificateNames ...string) Satellite {
+	s := Satellite{Name: "sat1", CertificateAuth: certificateAuth, CertificateNames: certificateNames}
+	if err := s.setSecret(secret); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestAuthenticateSatelliteCertificate(t *testing.T) {
+	tests := []struct {
+		name        string
+		satellite   Satellite
+		request     *http.Request
+		secret      string
+		expectError bool
+	}{
+		// secret only, certificates are ignored
+		{"secret only with secret", satelliteWithSecret("s", ""), requestWithCertificate(""), "s", false},
+		{"secret only with cert", satelliteWithSecret("s", ""), requestWithCertificate("sat1"), "", true},
+
+		// certificate replaces the secret
+		{"sufficient with cn", satelliteWithSecret("s", CertificateAuthSufficient),
+			requestWithCertificate("sat1"), "", false},
+		{"sufficient with san", satelliteWithSecret("s", CertificateAuthSufficient),
+			requestWithCertificate("other", "sat1"), "", false},
+		{"sufficient with alias", satelliteWithSecret("s", CertificateAuthSufficient, "probe.example.com"),
+			requestWithCertificate("probe.example.com"), "", false},
+		{"sufficient with foreign cert", satelliteWithSecret("s", CertificateAuthSufficient),
+			requestWithCertificate("sat2"), "", true},
+		{"sufficient falls back to secret", satelliteWithSecret("s", CertificateAuthSufficient),
+			requestWithCertificate(""), "s", false},
+
+		// certificate supplements the secret
+		{"required with both", satelliteWithSecret("s", CertificateAuthRequired),
+			requestWithCertificate("sat1"), "s", false},
+		{"required without secret", satelliteWithSecret("s", CertificateAuthRequired),
+			requestWithCertificate("sat1"), "", true},
+		{"required without cert", satelliteWithSecret("s", CertificateAuthRequired),
+			requestWithCertificate(""), "s", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.secret != "" {
+				tt.request.Header.Set(HeaderAuthorization, tt.secret)
+			}
+			_, err := authenticateSatellite(tt.request, tt.satellite)
+			if tt.expectError && err == nil {
+				t.Errorf("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateSatelliteSignature(t *testing.T) {
+	optional := satelliteWithSecret("s", "")
+	required := optional
+	required.RequireSignature = true
+	hashOnly := optional
+	hashOnly.SigningKey = ""
+
+	signed := func(secret string) *http.Request {
+		r := httptest.NewRequest("GET", "http://head/satellites/sat1/targets", nil)
+		if err := SignRequest(r, deriveSigningKey(secret), nil); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	unsigned := func(secret string) *http.Request {
+		r := httptest.NewRequest("GET", "http://head/satellites/sat1/targets", nil)
+		r.Header.Set(HeaderAuthorization, secret)
+		return r
+	}
+
+	tests := []struct {
+		name        string
+		satellite   Satellite
+		request     *http.Request
+		expectError bool
+	}{
+		{"optional signed", optional, signed("s"), false},
+		{"optional unsigned", optional, unsigned("s"), false},
+		{"optional signed with wrong secret", optional, signed("x"), true},
+		{"required signed", required, signed("s"), false},
+		{"required unsigned", required, unsigned("s"), true},
+		{"no signing key signed", hashOnly, signed("s"), true},
+		{"no signing key unsigned", hashOnly, unsigned("s"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticateSatellite(tt.request, tt.satellite)
+			if tt.expectError && err == nil {
+				t.Errorf("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateSatelliteRequireSignature(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	hashOnly := satelliteWithSecret("s", "")
+	hashOnly.Name, hashOnly.SigningKey = "sat2", ""
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog: filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{
+			"sat1": satelliteWithSecret("s", ""),
+			"sat2": hashOnly,
+		},
+	}
+	cMutex.Unlock()
+
+	tests := []struct {
+		name      string
+		satellite string
+		body      string
+		status    int
+		required  bool
+	}{
+		{"enable", "sat1", `{"RequireSignature": true}`, 200, true},
+		{"kept if not given", "sat1", `{"Active": true}`, 200, true},
+		{"disable", "sat1", `{"RequireSignature": false}`, 200, false},
+		{"enable without signing key", "sat2", `{"RequireSignature": true}`, 422, false},
+		{"enable with new secret", "sat2", `{"RequireSignature": true, "Secret": "t"}`, 200, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withNameParam(httptest.NewRequest("PATCH", "/satellites/x", strings.NewReader(tt.body)), tt.satellite)
+			w := httptest.NewRecorder()
+			UpdateSatellite(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			cMutex.RLock()
+			defer cMutex.RUnlock()
+			if got := Config.Satellites[tt.satellite].RequireSignature; got != tt.required {
+				t.Errorf("RequireSignature = %v, want %v", got, tt.required)
+			}
+		})
+	}
+}
+
+// withNameParam sets the chi URL parameter name of r, as the router would.
+func withNameParam(r *http.Request, name string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", name)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
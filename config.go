@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ProbeTypes a target can use.
+var validProbeTypes = []string{"icmp", "http"}
+
+// ConfigError is a problem with a single setting of a configuration.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// ConfigErrors is returned when a configuration failed validation.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// normalizeConfig injects the map keys as names. Probe defaults are applied
+// when the targets of a satellite are resolved, see resolveTargets.
+func normalizeConfig(c *Configuration) {
+	for name, s := range c.Satellites {
+		s.Name = name
+		c.Satellites[name] = s
+	}
+	for name, g := range c.SatelliteGroups {
+		g.Name = name
+		c.SatelliteGroups[name] = g
+	}
+	for name, d := range c.Discovery {
+		d.Name = name
+		c.Discovery[name] = d
+	}
+	for name, k := range c.Targets {
+		k.Name = name
+		c.Targets[name] = k
+	}
+	for name, t := range c.Tokens {
+		t.Name = name
+		c.Tokens[name] = t
+	}
+	for name, t := range c.Enrollments {
+		t.Name = name
+		c.Enrollments[name] = t
+	}
+}
+
+// validateConfig checks a normalized configuration and returns all problems
+// found, sorted by path.
+func validateConfig(c *Configuration) []ConfigError {
+	var errs []ConfigError
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	for _, s := range c.Satellites {
+		errs = append(errs, validateSatellite(c, s)...)
+		// satellites hashed before signing keys were derived need their
+		// secret again to require signatures
+		if s.RequireSignature && s.Secret == "" && s.SigningKey == "" {
+			add("satellites."+s.Name+".require_signature", errors.New("no signing key, set the secret again to derive one"))
+		}
+	}
+
+	for _, g := range c.SatelliteGroups {
+		errs = append(errs, validateSatelliteGroup(c, g)...)
+	}
+
+	for _, d := range c.Discovery {
+		errs = append(errs, validateDiscovery(c, d)...)
+	}
+
+	for _, t := range c.Targets {
+		errs = append(errs, validateTarget(c, t)...)
+	}
+
+	for name, t := range c.TargetTemplates {
+		path := "target_templates." + name
+		if err := ValidateIdentifier(name, "template name"); err != nil {
+			add(path, err)
+		}
+		errs = append(errs, validateProbeDefaults(path, t)...)
+	}
+
+	for name, t := range c.Tokens {
+		path := "tokens." + name
+		if err := ValidateIdentifier(name, "token name"); err != nil {
+			add(path, err)
+		}
+		if err := ValidateScopes(t.Scopes); err != nil {
+			add(path+".scopes", err)
+		}
+	}
+
+	for name, t := range c.Enrollments {
+		path := "enrollment_tokens." + name
+		if err := ValidateIdentifier(name, "token name"); err != nil {
+			add(path, err)
+		}
+		for _, target := range t.Targets {
+			if _, found := c.Targets[target]; !found {
+				add(path+".targets", fmt.Errorf("target %s is not defined", target))
+			}
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+// validateTarget checks a target against the configuration c.
+func validateTarget(c *Configuration, t Target) []ConfigError {
+	var errs []ConfigError
+	path := "targets." + t.Name
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	if err := ValidateIdentifier(t.Name, "target name"); err != nil {
+		add(path, err)
+	}
+	switch {
+	case t.SRV != "" && t.Host != "":
+		add(path+".srv", errors.New("host and srv cannot both be set"))
+	case t.SRV != "":
+		if err := validateSRV(t.SRV); err != nil {
+			add(path+".srv", err)
+		}
+	case t.Host == "":
+		add(path+".host", errors.New("host cannot be empty"))
+	}
+	errs = append(errs, validateProbeDefaults(path, ProbeDefaults{
+		ProbeType: t.ProbeType,
+		Probes:    t.Probes,
+		Interval:  t.Interval,
+		BatchSize: t.BatchSize,
+	})...)
+	if _, found := c.TargetTemplates[t.Template]; t.Template != "" && !found {
+		add(path+".template", fmt.Errorf("target template %s is not defined", t.Template))
+	}
+	for _, g := range t.Groups {
+		if err := ValidateIdentifier(g, "group name"); err != nil {
+			add(path+".groups", err)
+		}
+	}
+	for k := range t.Tags {
+		if k == "" || strings.ContainsAny(k, ",=!") {
+			add(path+".tags", fmt.Errorf("invalid tag name %q", k))
+		}
+	}
+
+	return errs
+}
+
+// validateSatellite checks a satellite against the configuration c.
+func validateSatellite(c *Configuration, s Satellite) []ConfigError {
+	var errs []ConfigError
+	path := "satellites." + s.Name
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	if err := ValidateIdentifier(s.Name, "satellite name"); err != nil {
+		add(path, err)
+	}
+	if err := ValidateCertificateAuth(s.CertificateAuth); err != nil {
+		add(path+".certificate_auth", err)
+	}
+	for _, t := range s.Targets {
+		if _, found := c.Targets[t]; !found {
+			add(path+".targets", fmt.Errorf("target %s is not defined", t))
+		}
+	}
+	for _, g := range s.TargetGroups {
+		if err := ValidateIdentifier(g, "group name"); err != nil {
+			add(path+".target_groups", err)
+		}
+	}
+	for _, selector := range s.TargetSelectors {
+		if _, err := ParseTargetSelector(selector); err != nil {
+			add(path+".target_selectors", err)
+		}
+	}
+	for _, g := range s.Groups {
+		if _, found := c.SatelliteGroups[g]; !found {
+			add(path+".groups", fmt.Errorf("satellite group %s is not defined", g))
+		}
+	}
+	errs = append(errs, validateOverrides(c, s)...)
+
+	return errs
+}
+
+// validateSatelliteGroup checks a satellite group against the configuration c.
+func validateSatelliteGroup(c *Configuration, g SatelliteGroup) []ConfigError {
+	var errs []ConfigError
+	path := "satellite_groups." + g.Name
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	if err := ValidateIdentifier(g.Name, "group name"); err != nil {
+		add(path, err)
+	}
+	for _, t := range g.Targets {
+		if _, found := c.Targets[t]; !found {
+			add(path+".targets", fmt.Errorf("target %s is not defined", t))
+		}
+	}
+	for _, tg := range g.TargetGroups {
+		if err := ValidateIdentifier(tg, "group name"); err != nil {
+			add(path+".target_groups", err)
+		}
+	}
+	for _, selector := range g.TargetSelectors {
+		if _, err := ParseTargetSelector(selector); err != nil {
+			add(path+".target_selectors", err)
+		}
+	}
+	errs = append(errs, validateProbeDefaults(path+".defaults", g.Defaults)...)
+
+	return errs
+}
+
+// validateProbeDefaults checks probe settings. Unset settings are valid,
+// defaults are applied for them.
+func validateProbeDefaults(path string, d ProbeDefaults) []ConfigError {
+	var errs []ConfigError
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	if d.ProbeType != "" && !slices.Contains(validProbeTypes, d.ProbeType) {
+		add(path+".probe_type", fmt.Errorf("unknown probe type %q - valid probe types are %s",
+			d.ProbeType, strings.Join(validProbeTypes, ", ")))
+	}
+	if d.Interval < 0 {
+		add(path+".interval", errors.New("interval must be positive"))
+	}
+	if d.Probes < 0 {
+		add(path+".probes", errors.New("probes must be positive"))
+	}
+	if d.BatchSize < 0 {
+		add(path+".batch_size", errors.New("batch size must be positive"))
+	}
+
+	return errs
+}
+
+// readConfig parses a configuration of the given config type (json, yaml or
+// toml) with a separate viper instance, so the running configuration is not
+// touched. Values are resolved with resolve, see resolveReference and
+// keepReferences, and the resolved references returned. With a nil resolve
+// the values are kept as they are.
+func readConfig(data []byte, typ string, resolve referenceResolver) (Configuration, map[string]configReference, error) {
+	var c Configuration
+	var references map[string]configReference
+
+	v := viper.New()
+	v.SetConfigType(typ)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return c, nil, err
+	}
+	if resolve != nil {
+		var err error
+		if references, err = interpolateConfig(v, resolve); err != nil {
+			return c, nil, err
+		}
+	}
+	if err := v.Unmarshal(&c); err != nil {
+		return c, nil, err
+	}
+	normalizeConfig(&c)
+
+	return c, references, nil
+}
+
+// persistedConfig returns the running configuration as it is written and
+// shown, with its references instead of the values they resolved to. Callers
+// hold cMutex.
+func persistedConfig() Configuration {
+	return withReferences(Config, configReferences)
+}
+
+// applyConfig replaces the running configuration with c, read from data of
+// the given config type with references, and persists it as a new version.
+// Runtime state of satellites is kept. If the config can't be written the
+// running configuration stays unchanged.
+func applyConfig(c Configuration, references map[string]configReference, data []byte, typ string) (before SafeConfiguration, after SafeConfiguration, err error) {
+	cMutex.Lock()
+	defer cMutex.Unlock()
+
+	previous, previousReferences := Config, configReferences
+	before = persistedConfig().SafeForLogging()
+
+	// WriteConfig persists the global viper, settings outside the sections it sets come from data
+	viper.SetConfigType(typ)
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		return before, before, err
+	}
+
+	keepRuntimeState(&c, previous)
+	c.Version = previous.Version
+	Config, configReferences = c, references
+
+	// WriteConfig sets the version of the config to NOW
+	if err := WriteConfig(); err != nil {
+		Config, configReferences = previous, previousReferences
+		_ = viper.ReadInConfig()
+		return before, before, err
+	}
+	restartDiscovery()
+
+	return before, persistedConfig().SafeForLogging(), nil
+}
+
+// configFileFingerprint identifies the effective configuration last read
+// from or written to ConfigFile. Guarded by cMutex.
+var configFileFingerprint string
+
+// fingerprintConfig hashes the persisted settings of c, ignoring its version.
+func fingerprintConfig(c Configuration) string {
+	c.Version = 0
+	data, _ := json.Marshal(configValue(reflect.ValueOf(c)))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// rememberConfigFile records the fingerprint of what is in ConfigFile now.
+// Callers hold cMutex.
+func rememberConfigFile() error {
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		return err
+	}
+	c, _, err := readConfig(data, configType(ConfigFile), resolveReference)
+	if err != nil {
+		return err
+	}
+	configFileFingerprint = fingerprintConfig(c)
+	return nil
+}
+
+// reloadConfig reads ConfigFile into a new configuration and swaps it in if
+// it is valid and differs from what was last read or written. Validation
+// problems are returned as ConfigErrors, the running configuration stays
+// untouched on any error. Plaintext satellite secrets are hashed and written
+// back.
+func reloadConfig() (before SafeConfiguration, after SafeConfiguration, changed bool, err error) {
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		return before, after, false, err
+	}
+
+	c, references, err := readConfig(data, configType(ConfigFile), resolveReference)
+	if err != nil {
+		return before, after, false, err
+	}
+
+	if errs := validateConfig(&c); len(errs) > 0 {
+		return before, after, false, ConfigErrors(errs)
+	}
+
+	fingerprint := fingerprintConfig(c)
+
+	cMutex.RLock()
+	before = persistedConfig().SafeForLogging()
+	unchanged := fingerprint == configFileFingerprint
+	cMutex.RUnlock()
+
+	if unchanged {
+		return before, before, false, nil
+	}
+
+	migrated, err := migrateSatelliteSecrets(&c, references)
+	if err != nil {
+		return before, after, false, fmt.Errorf("hashing satellite secrets: %w", err)
+	}
+
+	cMutex.Lock()
+	defer cMutex.Unlock()
+
+	previous, previousReferences := Config, configReferences
+	before = persistedConfig().SafeForLogging()
+
+	viper.SetConfigType(configType(ConfigFile))
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		return before, before, false, err
+	}
+
+	keepRuntimeState(&c, previous)
+
+	// set Version of config to NOW
+	c.Version = time.Now().Unix()
+	if c.Version <= previous.Version {
+		c.Version = previous.Version + 1
+	}
+	Config, configReferences = c, references
+
+	if migrated {
+		log.Info("Plaintext satellite secrets found, storing them hashed")
+		if err := WriteConfig(); err != nil {
+			Config, configReferences = previous, previousReferences
+			return before, before, false, fmt.Errorf("storing hashed satellite secrets: %w", err)
+		}
+	} else {
+		configFileFingerprint = fingerprint
+		if err := saveConfigHistory(); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Error("Error while storing config history")
+		}
+	}
+	restartDiscovery()
+
+	return before, persistedConfig().SafeForLogging(), true, nil
+}
+
+// keepRuntimeState copies the state gathered at runtime, satellite health,
+// discovered targets and satellites and when API tokens were last used, from
+// previous into c.
+func keepRuntimeState(c *Configuration, previous Configuration) {
+	c.Discovered = previous.Discovered
+	for name, t := range c.Tokens {
+		if p, found := previous.Tokens[name]; found && p.Hash == t.Hash && p.LastUsed > t.LastUsed {
+			t.LastUsed = p.LastUsed
+			c.Tokens[name] = t
+		}
+	}
+	for name, s := range previous.Satellites {
+		if _, found := c.Satellites[name]; s.Discovery != "" && !found {
+			if c.Satellites == nil {
+				c.Satellites = make(map[string]Satellite)
+			}
+			c.Satellites[name] = s
+		}
+	}
+	for name, s := range c.Satellites {
+		if p, found := previous.Satellites[name]; found {
+			s.LastData = p.LastData
+			s.Health = p.Health
+			c.Satellites[name] = s
+		}
+	}
+}
+
+// keepHiddenCredentials puts the credentials that GET /config doesn't show
+// back into c, an uploaded configuration, so that a downloaded configuration
+// can be uploaded again. Satellites, API tokens and enrollment tokens without
+// a secret or hash keep those of current, masked values keep the value and
+// reference they mask. Entries left without credentials are returned as
+// errors. Callers hold cMutex.
+func keepHiddenCredentials(c *Configuration, references map[string]configReference, current Configuration) []ConfigError {
+	var errs []ConfigError
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	for name, s := range c.Satellites {
+		if s.Secret != "" || s.SecretHash != "" {
+			continue
+		}
+		if p, found := current.Satellites[name]; found && p.SecretHash != "" {
+			s.SecretHash = p.SecretHash
+			s.SigningKey = p.SigningKey
+			s.PreviousSecretHash = p.PreviousSecretHash
+			s.PreviousSigningKey = p.PreviousSigningKey
+			s.PreviousSecretExpires = p.PreviousSecretExpires
+			s.PendingSecret = p.PendingSecret
+			s.LastSecretUsed = p.LastSecretUsed
+			// a secret referring to the environment or a file stays a reference
+			path := "satellites." + strings.ToLower(name) + ".secret"
+			if r, found := configReferences[path]; found && p.Secret == r.resolved {
+				s.Secret = p.Secret
+				references[path] = r
+			}
+			c.Satellites[name] = s
+		} else if s.CertificateAuth != CertificateAuthSufficient {
+			add("satellites."+name+".secret", errors.New("no secret, set one or create the satellite through the API"))
+		}
+	}
+
+	for name, t := range c.Tokens {
+		if t.Hash != "" {
+			continue
+		}
+		if p, found := current.Tokens[name]; found && p.Hash != "" {
+			t.Hash = p.Hash
+			c.Tokens[name] = t
+		} else {
+			add("tokens."+name+".hash", errors.New("no hash, create tokens through the API"))
+		}
+	}
+
+	for name, e := range c.Enrollments {
+		if e.Hash != "" {
+			continue
+		}
+		if p, found := current.Enrollments[name]; found && p.Hash != "" {
+			e.Hash = p.Hash
+			c.Enrollments[name] = e
+		} else {
+			add("enrollment_tokens."+name+".hash", errors.New("no hash, create enrollment tokens through the API"))
+		}
+	}
+
+	keepMasked := func(path string, uploaded *string, value string) {
+		shown := value
+		r, found := configReferences[path]
+		if found && r.resolved == value {
+			shown = r.raw
+		}
+		if *uploaded == "" || *uploaded != maskSecret(shown) {
+			return
+		}
+		*uploaded = value
+		if found {
+			references[path] = r
+		}
+	}
+	keepMasked("authorization", &c.Authorization, current.Authorization)
+	keepMasked("database.token", &c.Database.Token, current.Database.Token)
+	for name, d := range c.Discovery {
+		if p, found := current.Discovery[name]; found {
+			keepMasked("discovery."+strings.ToLower(name)+".token", &d.Token, p.Token)
+			c.Discovery[name] = d
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+// configSection converts a map of config structs into maps keyed by their
+// mapstructure tags, so that WriteConfig persists keys in the same form
+// parseConfig reads them back. The outer map is typed on purpose: viper treats
+// it as a single value and replaces the section instead of merging it with
+// what was read from disk, which keeps deletions intact.
+func configSection[T any](items map[string]T) map[string]map[string]interface{} {
+	section := make(map[string]map[string]interface{}, len(items))
+	for name, item := range items {
+		if m, ok := configValue(reflect.ValueOf(item)).(map[string]interface{}); ok {
+			section[name] = m
+		}
+	}
+	return section
+}
+
+// configValue recursively converts v into plain maps and slices using the
+// mapstructure tags of struct fields. Fields tagged with "-" are skipped.
+func configValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem())
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return v.Interface()
+		}
+		out := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if strings.Contains(opts, "omitempty") && v.Field(i).IsZero() {
+				continue
+			}
+			out[name] = configValue(v.Field(i))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = configValue(iter.Value())
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out[i] = configValue(v.Index(i))
+		}
+		return out
+	default:
+		return v.Interface()
+	}
+}
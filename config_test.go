@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+  "authorization": "admin",
+  "satellites": {
+    "sat1": {"secret_hash": "x", "targets": ["server1"], "active": true}
+  },
+  "targets": {
+    "server1": {"host": "foo.example.com"}
+  }
+}`
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{"valid with defaults", testConfig, nil},
+		{"unknown target", `{"satellites": {"sat1": {"targets": ["server2"]}}}`, []string{"satellites.sat1.targets"}},
+		{"invalid satellite name", `{"satellites": {"-sat": {"active": true}}}`, []string{"satellites.-sat"}},
+		{"signature without signing key", `{"satellites": {"sat1": {"secret_hash": "x", "require_signature": true}}}`, []string{"satellites.sat1.require_signature"}},
+		{"invalid certificate auth", `{"satellites": {"sat1": {"certificate_auth": "maybe"}}}`, []string{"satellites.sat1.certificate_auth"}},
+		{"unknown probe type", `{"targets": {"server1": {"host": "foo", "probe_type": "smoke"}}}`, []string{"targets.server1.probe_type"}},
+		{"negative interval and no host", `{"targets": {"server1": {"interval": -1}}}`, []string{"targets.server1.host", "targets.server1.interval"}},
+		{"unknown template", `{"targets": {"server1": {"host": "foo", "template": "fast"}}}`, []string{"targets.server1.template"}},
+		{"invalid template", `{"target_templates": {"fast": {"probe_type": "smoke"}}}`, []string{"target_templates.fast.probe_type"}},
+		{"override of unknown target", `{"satellites": {"sat1": {"overrides": {"server2": {"host": "10.0.0.1"}}}}}`, []string{"satellites.sat1.overrides.server2"}},
+		{"override of discovered target", `{"discovery": {"cmdb": {"type": "http", "url": "http://cmdb"}}, "satellites": {"sat1": {"overrides": {"cmdb-web1-443": {"host": "10.0.0.1"}}}}}`, nil},
+		{"override of srv target", `{"targets": {"api": {"srv": "_https._tcp.example.com"}}, "satellites": {"sat1": {"overrides": {"api-api1.example.com-443": {"interval": 30}}}}}`, nil},
+		{"discovery without url", `{"discovery": {"cmdb": {"type": "http"}}}`, []string{"discovery.cmdb.url"}},
+		{"unknown discovery type", `{"discovery": {"cmdb": {"type": "ldap"}}}`, []string{"discovery.cmdb.type"}},
+		{"srv and host", `{"targets": {"api": {"host": "foo", "srv": "_https._tcp.example.com"}}}`, []string{"targets.api.srv"}},
+		{"invalid srv", `{"targets": {"api": {"srv": "example.com"}}}`, []string{"targets.api.srv"}},
+		{"unknown scope", `{"tokens": {"t1": {"scopes": ["root"]}}}`, []string{"tokens.t1.scopes"}},
+		{"enrollment with unknown target", `{"enrollment_tokens": {"e1": {"targets": ["server9"]}}}`, []string{"enrollment_tokens.e1.targets"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, err := readConfig([]byte(tt.config), "json", resolveReference)
+			if err != nil {
+				t.Fatalf("readConfig() error = %v", err)
+			}
+
+			var paths []string
+			for _, e := range validateConfig(&c) {
+				paths = append(paths, e.Path)
+			}
+
+			if strings.Join(paths, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("validateConfig() = %v, want %v", paths, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConfigUpload(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog: filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{
+			"sat1": {Name: "sat1", SecretHash: "x", Targets: []string{"server1"}},
+		},
+		Targets: map[string]Target{
+			"server1": {Name: "server1", Host: "foo.example.com"},
+		},
+	}
+	cMutex.Unlock()
+
+	tests := []struct {
+		name    string
+		query   string
+		config  string
+		status  int
+		errors  int
+		changes []string
+		applied bool
+	}{
+		{"malformed", "", `{"satellites": `, 400, 1, nil, false},
+		{"invalid", "", `{"satellites": {"sat1": {"targets": ["server2"]}}, "targets": {"server1": {"host": "foo", "probe_type": "smoke"}}}`, 422, 2, nil, false},
+		{"dry run", "?dry_run=true", testConfig, 200, 0, []string{"audit_log", "authorization", "satellites.sat1.active"}, false},
+		{"upload", "", testConfig, 200, 0, nil, true},
+		{"satellite without secret", "", `{"satellites": {"sat2": {"active": true}}}`, 422, 1, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ConfigUpload(w, httptest.NewRequest("PUT", "/config"+tt.query, strings.NewReader(tt.config)))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+
+			if tt.errors > 0 {
+				var response ErrorResponse
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+					t.Fatalf("decoding errors: %v", err)
+				}
+				if len(response.Errors) != tt.errors {
+					t.Errorf("errors = %d, want %d", len(response.Errors), tt.errors)
+				}
+			}
+
+			if tt.changes != nil {
+				var changes []ConfigChange
+				if err := json.NewDecoder(w.Body).Decode(&changes); err != nil {
+					t.Fatalf("decoding changes: %v", err)
+				}
+				var paths []string
+				for _, c := range changes {
+					paths = append(paths, c.Path)
+				}
+				if strings.Join(paths, ",") != strings.Join(tt.changes, ",") {
+					t.Errorf("changes = %v, want %v", paths, tt.changes)
+				}
+			}
+
+			cMutex.RLock()
+			applied := Config.Authorization == "admin"
+			cMutex.RUnlock()
+			if applied != tt.applied {
+				t.Errorf("config applied = %v, want %v", applied, tt.applied)
+			}
+		})
+	}
+
+	// a downloaded configuration can be uploaded again without losing the
+	// credentials it doesn't show
+	cMutex.Lock()
+	Config.Tokens = map[string]APIToken{"reader": {Name: "reader", Hash: "reader-hash", Scopes: []string{ScopeReadOnly}}}
+	before := Config
+	cMutex.Unlock()
+
+	w := httptest.NewRecorder()
+	ConfigGet(w, httptest.NewRequest("GET", "/config", nil))
+	downloaded := w.Body.String()
+	if strings.Contains(downloaded, "reader-hash") || strings.Contains(downloaded, `"admin"`) {
+		t.Fatalf("GET /config shows credentials: %s", downloaded)
+	}
+
+	w = httptest.NewRecorder()
+	ConfigUpload(w, httptest.NewRequest("PUT", "/config", strings.NewReader(downloaded)))
+	if w.Code != 200 {
+		t.Fatalf("round trip status = %d: %s", w.Code, w.Body.String())
+	}
+
+	cMutex.RLock()
+	defer cMutex.RUnlock()
+	if Config.Satellites["sat1"].SecretHash != before.Satellites["sat1"].SecretHash {
+		t.Errorf("satellite secret lost in round trip: %+v", Config.Satellites["sat1"])
+	}
+	if Config.Tokens["reader"].Hash != "reader-hash" {
+		t.Errorf("token hash lost in round trip: %+v", Config.Tokens["reader"])
+	}
+	if Config.Authorization != "admin" {
+		t.Errorf("authorization = %q after round trip, want it kept", Config.Authorization)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	lastData := time.Now().Add(-time.Minute)
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:   filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{"sat1": {Name: "sat1", LastData: lastData, Health: true}},
+	}
+	configFileFingerprint = ""
+	cMutex.Unlock()
+
+	tests := []struct {
+		name    string
+		config  string
+		status  int
+		applied bool
+		bumped  bool
+	}{
+		{"malformed", `{"satellites": `, 422, false, false},
+		{"invalid", `{"satellites": {"sat1": {"targets": ["server2"]}}}`, 422, false, false},
+		{"valid", testConfig, 200, true, true},
+		{"unchanged", testConfig, 200, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(ConfigFile, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cMutex.RLock()
+			version := Config.Version
+			cMutex.RUnlock()
+
+			w := httptest.NewRecorder()
+			ConfigReload(w, httptest.NewRequest("POST", "/config", nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+
+			cMutex.RLock()
+			defer cMutex.RUnlock()
+			if applied := Config.Authorization == "admin"; applied != tt.applied {
+				t.Errorf("config applied = %v, want %v", applied, tt.applied)
+			}
+			if !Config.Satellites["sat1"].LastData.Equal(lastData) || !Config.Satellites["sat1"].Health {
+				t.Errorf("runtime state of satellite lost")
+			}
+			if bumped := Config.Version != version; bumped != tt.bumped {
+				t.Errorf("version bumped = %v, want %v", bumped, tt.bumped)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// consulServiceEntry is an entry of the Consul health API.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		Service string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// consulKVPair is an entry of the Consul KV API.
+type consulKVPair struct {
+	Key   string
+	Value []byte // base64 in JSON
+}
+
+// kvSecrets caches the hashes of plaintext secrets of satellites read from
+// Consul KV per discovery, so they are not hashed again on every refresh.
+// Each refresh replaces the cache of its discovery with the secrets it read.
+var kvSecrets = struct {
+	sync.Mutex
+	hashes map[string]map[[sha256.Size]byte]Satellite
+}{hashes: map[string]map[[sha256.Size]byte]Satellite{}}
+
+// consulGet fetches path from the Consul API of d and decodes the JSON
+// response into v. It reports false if the path doesn't exist.
+func consulGet(ctx context.Context, d DiscoveryConfig, path string, query url.Values, v interface{}) (bool, error) {
+	if d.Datacenter != "" {
+		query.Set("dc", d.Datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(d.URL, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	if d.Token != "" {
+		req.Header.Set("X-Consul-Token", d.Token)
+	}
+
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned %s", req.URL.Path, resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(v); err != nil {
+		return false, fmt.Errorf("parsing response of %s: %w", req.URL.Path, err)
+	}
+	return true, nil
+}
+
+// discoverConsul fetches the instances of the services in the Consul catalog,
+// or of d.Services if set. Each instance is labeled with service, node,
+// datacenter and health (passing, warning or critical), its service tags as
+// tag.<tag> and its service meta data as meta.<key>.
+func discoverConsul(ctx context.Context, d DiscoveryConfig) ([]sdGroup, error) {
+	services := d.Services
+	if len(services) == 0 {
+		var catalog map[string][]string
+		if _, err := consulGet(ctx, d, "/v1/catalog/services", url.Values{}, &catalog); err != nil {
+			return nil, err
+		}
+		for service := range catalog {
+			if service != "consul" {
+				services = append(services, service)
+			}
+		}
+		slices.Sort(services)
+	}
+
+	var groups []sdGroup
+	for _, service := range services {
+		query := url.Values{}
+		if d.PassingOnly {
+			query.Set("passing", "true")
+		}
+
+		var entries []consulServiceEntry
+		if _, err := consulGet(ctx, d, "/v1/health/service/"+url.PathEscape(service), query, &entries); err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			address := e.Service.Address
+			if address == "" {
+				address = e.Node.Address
+			}
+			if e.Service.Port != 0 {
+				address = net.JoinHostPort(address, strconv.Itoa(e.Service.Port))
+			}
+
+			labels := map[string]string{
+				"service":    e.Service.Service,
+				"node":       e.Node.Node,
+				"datacenter": e.Node.Datacenter,
+				"health":     consulHealth(e),
+			}
+			for _, tag := range e.Service.Tags {
+				labels["tag."+tag] = ""
+			}
+			for k, v := range e.Service.Meta {
+				labels["meta."+k] = v
+			}
+
+			groups = append(groups, sdGroup{Targets: []string{address}, Labels: labels})
+		}
+	}
+	return groups, nil
+}
+
+// consulHealth returns the worst status of the checks of a service instance.
+func consulHealth(e consulServiceEntry) string {
+	health := "passing"
+	for _, check := range e.Checks {
+		switch check.Status {
+		case "critical":
+			return "critical"
+		case "warning":
+			health = "warning"
+		}
+	}
+	return health
+}
+
+// consulSatellites reads satellite definitions from the KV prefix of d. Each
+// key below the prefix holds one satellite in the same format as in the
+// config file, the last part of the key is the satellite name. Plaintext
+// secrets are hashed in memory only.
+func consulSatellites(ctx context.Context, d DiscoveryConfig) (map[string]Satellite, error) {
+	var pairs []consulKVPair
+	prefix := strings.Trim(d.KVPrefix, "/") + "/"
+	if _, err := consulGet(ctx, d, "/v1/kv/"+prefix, url.Values{"recurse": {"true"}}, &pairs); err != nil {
+		return nil, err
+	}
+
+	kvSecrets.Lock()
+	cached := kvSecrets.hashes[d.Name]
+	kvSecrets.Unlock()
+	hashes := map[[sha256.Size]byte]Satellite{}
+
+	satellites := map[string]Satellite{}
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") || len(pair.Value) == 0 {
+			continue
+		}
+		name := strings.ToLower(path.Base(pair.Key))
+
+		var satellite Satellite
+		v := viper.New()
+		v.SetConfigType("json")
+		err := v.ReadConfig(bytes.NewReader(pair.Value))
+		if err == nil {
+			err = v.Unmarshal(&satellite)
+		}
+		if err == nil && satellite.Secret != "" {
+			err = hashKVSecret(&satellite, cached, hashes)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"discovery": d.Name, "key": pair.Key, "error": err}).Warn("Skipping satellite")
+			continue
+		}
+
+		satellite.Name = name
+		satellite.Discovery = d.Name
+		satellites[name] = satellite
+	}
+
+	kvSecrets.Lock()
+	kvSecrets.hashes[d.Name] = hashes
+	kvSecrets.Unlock()
+	return satellites, nil
+}
+
+// hashKVSecret replaces the plaintext secret of a satellite read from Consul
+// KV with its hash, taken from cached if the secret was hashed before. The
+// hash is recorded in hashes.
+func hashKVSecret(satellite *Satellite, cached, hashes map[[sha256.Size]byte]Satellite) error {
+	key := sha256.Sum256([]byte(satellite.Secret))
+
+	if hashed, found := cached[key]; found {
+		satellite.Secret = ""
+		satellite.SecretHash = hashed.SecretHash
+		satellite.SigningKey = hashed.SigningKey
+	} else if err := satellite.setSecret(satellite.Secret); err != nil {
+		return err
+	}
+	hashes[key] = Satellite{SecretHash: satellite.SecretHash, SigningKey: satellite.SigningKey}
+	return nil
+}
+
+// forgetKVSecrets drops the cached secret hashes of discoveries not in
+// discoveries.
+func forgetKVSecrets(discoveries map[string]bool) {
+	kvSecrets.Lock()
+	defer kvSecrets.Unlock()
+	for name := range kvSecrets.hashes {
+		if !discoveries[name] {
+			delete(kvSecrets.hashes, name)
+		}
+	}
+}
+
+// mergeSatellites replaces the satellites previously read by discovery with
+// satellites. Satellites from the config file take precedence, runtime state
+// of known satellites is kept. Callers hold cMutex.
+func mergeSatellites(c *Configuration, discovery string, satellites map[string]Satellite) {
+	for name, s := range c.Satellites {
+		if _, found := satellites[name]; s.Discovery == discovery && !found {
+			delete(c.Satellites, name)
+		}
+	}
+
+	for name, s := range satellites {
+		existing, found := c.Satellites[name]
+		if found && existing.Discovery != discovery {
+			log.WithFields(logrus.Fields{"discovery": discovery, "satellite": name}).Warn("Satellite is already defined, skipping")
+			continue
+		}
+		if errs := validateSatellite(c, s); len(errs) > 0 {
+			log.WithFields(logrus.Fields{"discovery": discovery, "satellite": name, "error": ConfigErrors(errs)}).Warn("Skipping invalid satellite")
+			continue
+		}
+
+		s.LastData = existing.LastData
+		s.Health = existing.Health
+		s.LastSecretUsed = existing.LastSecretUsed
+		if c.Satellites == nil {
+			c.Satellites = make(map[string]Satellite)
+		}
+		c.Satellites[name] = s
+	}
+}
+
+// configuredSatellites returns the satellites of the config file, without
+// the ones read from discovery.
+func configuredSatellites(satellites map[string]Satellite) map[string]Satellite {
+	configured := make(map[string]Satellite, len(satellites))
+	for name, s := range satellites {
+		if s.Discovery == "" {
+			configured[name] = s
+		}
+	}
+	return configured
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeConsul serves the parts of the Consul API used by the consul discovery.
+func fakeConsul(t *testing.T, satellites map[string]string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/catalog/services", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "acl" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"consul": [], "web": ["primary"]}`))
+	})
+	mux.HandleFunc("/v1/health/service/web", func(w http.ResponseWriter, r *http.Request) {
+		entries := `[
+			{"Node": {"Node": "n1", "Address": "10.0.0.1", "Datacenter": "fra"},
+			 "Service": {"Service": "web", "Port": 8080, "Tags": ["primary"], "Meta": {"team": "ops"}},
+			 "Checks": [{"Status": "passing"}, {"Status": "warning"}]},
+			{"Node": {"Node": "n2", "Address": "10.0.0.2", "Datacenter": "fra"},
+			 "Service": {"Service": "web", "Address": "192.168.0.2", "Port": 8080},
+			 "Checks": [{"Status": "critical"}]}
+		]`
+		if r.URL.Query().Get("passing") == "true" {
+			entries = `[]`
+		}
+		w.Write([]byte(entries))
+	})
+	mux.HandleFunc("/v1/kv/nprobe/satellites/", func(w http.ResponseWriter, r *http.Request) {
+		var pairs []consulKVPair
+		for name, value := range satellites {
+			pairs = append(pairs, consulKVPair{Key: "nprobe/satellites/" + name, Value: []byte(value)})
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	satellites := map[string]string{
+		"kv1":     `{"active": true, "secret": "kv1secret", "target_selectors": ["service=web"]}`,
+		"static1": `{"active": true, "secret": "other"}`,
+		"broken":  `{"active": true, "targets": ["missing"]}`,
+	}
+	server := fakeConsul(t, satellites)
+
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	consul := DiscoveryConfig{Name: "consul", Type: "consul", URL: server.URL, Token: "acl", KVPrefix: "nprobe/satellites"}
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:   filepath.Join(dir, "audit.log"),
+		Discovery:  map[string]DiscoveryConfig{"consul": consul},
+		Satellites: map[string]Satellite{"static1": {Name: "static1", Active: true}},
+	}
+	cMutex.Unlock()
+
+	if err := refreshDiscovery(context.Background(), consul); err != nil {
+		t.Fatalf("refreshDiscovery() error = %v", err)
+	}
+
+	cMutex.RLock()
+	kv1, found := Config.Satellites["kv1"]
+	_, broken := Config.Satellites["broken"]
+	static1 := Config.Satellites["static1"]
+	targets := resolveTargets(&Config, kv1)
+	cMutex.RUnlock()
+
+	if !found || kv1.Discovery != "consul" || kv1.SecretHash == "" || kv1.Secret != "" {
+		t.Errorf("satellite kv1 = %+v, want discovered with hashed secret", kv1)
+	}
+	if broken {
+		t.Errorf("invalid satellite from KV was added")
+	}
+	if static1.Discovery != "" {
+		t.Errorf("satellite from config file was replaced by KV")
+	}
+	if token := Config.SafeForLogging().Discovery["consul"].Token; token == consul.Token {
+		t.Errorf("consul token is not masked")
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		labels []string
+	}{
+		{"consul-10.0.0.1-8080", "10.0.0.1", []string{"datacenter=fra", "health=warning", "meta.team=ops", "node=n1", "tag.primary="}},
+		{"consul-192.168.0.2-8080", "192.168.0.2", []string{"health=critical", "node=n2"}},
+	}
+
+	if len(targets) != len(tests) {
+		t.Fatalf("resolveTargets() = %d targets, want %d", len(targets), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if targets[i].Name != tt.name || targets[i].Host != tt.host {
+				t.Errorf("target = %s (%s), want %s (%s)", targets[i].Name, targets[i].Host, tt.name, tt.host)
+			}
+			for _, label := range tt.labels {
+				k, v, _ := strings.Cut(label, "=")
+				if got, found := targets[i].Tags[k]; !found || got != v {
+					t.Errorf("tag %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+
+	// satellites read from KV are not written to the config file
+	cMutex.Lock()
+	err := WriteConfig()
+	cMutex.Unlock()
+	if err != nil {
+		t.Fatalf("WriteConfig() error = %v", err)
+	}
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, _, err := readConfig(data, "json", resolveReference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := written.Satellites["kv1"]; found {
+		t.Errorf("satellite kv1 was written to the config file")
+	}
+
+	// removed keys remove their satellites
+	delete(satellites, "kv1")
+	if err := refreshDiscovery(context.Background(), consul); err != nil {
+		t.Fatalf("refreshDiscovery() error = %v", err)
+	}
+	cMutex.RLock()
+	_, found = Config.Satellites["kv1"]
+	cMutex.RUnlock()
+	if found {
+		t.Errorf("satellite kv1 kept after its key was removed")
+	}
+	kvSecrets.Lock()
+	cached := len(kvSecrets.hashes["consul"])
+	kvSecrets.Unlock()
+	if cached != 1 {
+		t.Errorf("%d secret hashes cached after kv1 was removed, want 1", cached)
+	}
+	forgetKVSecrets(map[string]bool{})
+	kvSecrets.Lock()
+	_, found = kvSecrets.hashes["consul"]
+	kvSecrets.Unlock()
+	if found {
+		t.Errorf("secret hashes of a removed discovery kept")
+	}
+
+	consul.PassingOnly = true
+	groups, err := discoverConsul(context.Background(), consul)
+	if err != nil || len(groups) != 0 {
+		t.Errorf("discoverConsul() with passing_only = %v, %v, want no targets", groups, err)
+	}
+}
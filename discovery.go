@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v3"
+)
+
+const DefaultDiscoveryRefresh = 60 // seconds
+
+// discoveryChanged wakes the discovery loop when the configuration changed,
+// see restartDiscovery.
+var discoveryChanged = make(chan struct{}, 1)
+
+// DiscoveryConfig configures a source of targets. Discovered targets are
+// named "<discovery name>-<address>", tagged with discovery=<discovery name>
+// and their labels, and assigned to satellites via target groups and
+// selectors.
+type DiscoveryConfig struct {
+	Name string `mapstructure:"name"`
+	// Type is one of discoveryTypes
+	Type string `mapstructure:"type"`
+	// URL of a Prometheus http_sd endpoint for type http, of the Consul API for type consul
+	URL string `mapstructure:"url,omitempty"`
+	// Files in the Prometheus file_sd format (JSON or YAML), for type file; globs are expanded
+	Files []string `mapstructure:"files,omitempty"`
+	// Services to discover for type consul, defaults to all services of the catalog
+	Services    []string `mapstructure:"services,omitempty"`
+	Datacenter  string   `mapstructure:"datacenter,omitempty"`
+	Token       string   `mapstructure:"token,omitempty"`
+	PassingOnly bool     `mapstructure:"passing_only,omitempty"`
+	// KVPrefix holds satellite definitions for type consul
+	KVPrefix string `mapstructure:"kv_prefix,omitempty"`
+	// RefreshInterval in seconds, defaults to DefaultDiscoveryRefresh
+	RefreshInterval int `mapstructure:"refresh_interval,omitempty"`
+	// ProbeType of the discovered targets; http targets are probed at http://<address>
+	ProbeType string            `mapstructure:"probe_type,omitempty"`
+	Template  string            `mapstructure:"template,omitempty"`
+	Groups    []string          `mapstructure:"groups,omitempty"`
+	Tags      map[string]string `mapstructure:"tags,omitempty"`
+}
+
+// sdGroup is a list of targets sharing labels, as used by the Prometheus
+// http_sd and file_sd formats.
+type sdGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// discoverer fetches the current targets of a discovery.
+type discoverer func(ctx context.Context, d DiscoveryConfig) ([]sdGroup, error)
+
+// discoveryTypes are the supported discovery types.
+var discoveryTypes = map[string]discoverer{
+	"http":   discoverHTTP,
+	"file":   discoverFiles,
+	"consul": discoverConsul,
+}
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// invalidNameChars are replaced when discovered addresses are turned into
+// target names.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+func (d DiscoveryConfig) refreshInterval() time.Duration {
+	if d.RefreshInterval > 0 {
+		return time.Duration(d.RefreshInterval) * time.Second
+	}
+	return DefaultDiscoveryRefresh * time.Second
+}
+
+// discoverHTTP fetches targets from a Prometheus http_sd endpoint.
+func discoverHTTP(ctx context.Context, d DiscoveryConfig) ([]sdGroup, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Prometheus-Refresh-Interval-Seconds", strconv.Itoa(int(d.refreshInterval().Seconds())))
+
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", d.URL, resp.Status)
+	}
+
+	var groups []sdGroup
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("parsing response of %s: %w", d.URL, err)
+	}
+	return groups, nil
+}
+
+// discoverFiles reads targets from Prometheus file_sd files. Files ending in
+// .yaml or .yml are read as YAML, all others as JSON.
+func discoverFiles(_ context.Context, d DiscoveryConfig) ([]sdGroup, error) {
+	var groups []sdGroup
+	for _, pattern := range d.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			var fileGroups []sdGroup
+			if configType(file) == "yaml" {
+				err = yaml.Unmarshal(data, &fileGroups)
+			} else {
+				err = json.Unmarshal(data, &fileGroups)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", file, err)
+			}
+			groups = append(groups, fileGroups...)
+		}
+	}
+	return groups, nil
+}
+
+// discoveredTargets turns the groups found by discovery d into targets.
+// Labels starting with "__" are internal to Prometheus and are dropped, the
+// tags of d take precedence over labels.
+func discoveredTargets(d DiscoveryConfig, groups []sdGroup) map[string]Target {
+	targets := map[string]Target{}
+	for _, g := range groups {
+		for _, address := range g.Targets {
+			name := d.Name + "-" + strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(address), "-"), "-._")
+			if err := ValidateIdentifier(name, "target name"); err != nil {
+				log.WithFields(logrus.Fields{"discovery": d.Name, "address": address, "error": err}).Warn("Skipping discovered target")
+				continue
+			}
+
+			target := Target{
+				Name:      name,
+				Host:      discoveredHost(d, address, g.Labels),
+				ProbeType: d.ProbeType,
+				Template:  d.Template,
+				Groups:    d.Groups,
+				Tags:      map[string]string{},
+			}
+			for k, v := range g.Labels {
+				if !strings.HasPrefix(k, "__") && k != "" && !strings.ContainsAny(k, ",=!") {
+					target.Tags[k] = v
+				}
+			}
+			maps.Copy(target.Tags, d.Tags)
+			target.Tags["discovery"] = d.Name
+
+			targets[name] = target
+		}
+	}
+	return targets
+}
+
+// discoveredHost returns the host to probe for address. HTTP targets are
+// probed by URL, using the scheme from the __scheme__ label, other probes
+// don't use ports.
+func discoveredHost(d DiscoveryConfig, address string, labels map[string]string) string {
+	if d.ProbeType == "http" {
+		scheme := labels["__scheme__"]
+		if scheme == "" {
+			scheme = "http"
+		}
+		return scheme + "://" + address
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// refreshDiscovery fetches the targets and satellites of discovery d and
+// replaces its previously discovered ones. If fetching fails, the previous
+// targets and satellites are kept. Nothing is replaced once ctx is done, the
+// discovery was changed or removed meanwhile.
+func refreshDiscovery(ctx context.Context, d DiscoveryConfig) error {
+	discover, found := discoveryTypes[d.Type]
+	if !found {
+		return fmt.Errorf("unknown discovery type %q", d.Type)
+	}
+
+	groups, err := discover(ctx, d)
+	if err != nil {
+		return err
+	}
+	targets := discoveredTargets(d, groups)
+
+	var satellites map[string]Satellite
+	if d.KVPrefix != "" {
+		if satellites, err = consulSatellites(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	cMutex.Lock()
+	if err := ctx.Err(); err != nil {
+		cMutex.Unlock()
+		return err
+	}
+	if Config.Discovered == nil {
+		Config.Discovered = make(map[string]map[string]Target)
+	}
+	Config.Discovered[d.Name] = targets
+	mergeSatellites(&Config, d.Name, satellites)
+	cMutex.Unlock()
+
+	log.WithFields(logrus.Fields{"discovery": d.Name, "targets": len(targets), "satellites": len(satellites)}).Debug("Discovery refreshed")
+	return nil
+}
+
+// discoverySource is a discovery or an SRV target, refreshed by refresh,
+// which returns when to refresh it again.
+type discoverySource struct {
+	config  any
+	refresh func(ctx context.Context) time.Duration
+}
+
+// startDiscovery refreshes all configured discoveries in the background, each
+// on its own refresh interval, and expands SRV targets whenever the TTL of
+// their records expires. Every source is refreshed by its own goroutine, so a
+// slow one doesn't hold up the others. Sources changed since the last call of
+// restartDiscovery are restarted, targets of removed ones are dropped.
+// Everything stops when ctx is done, the returned channel is closed once it
+// did.
+func startDiscovery(ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+
+	go func() {
+		var running sync.WaitGroup
+		defer close(stopped)
+		defer running.Wait()
+
+		cancels := map[string]context.CancelFunc{}
+		current := map[string]any{}
+
+		for {
+			sources := map[string]discoverySource{}
+			discoveries := map[string]bool{}
+
+			cMutex.RLock()
+			for name, d := range Config.Discovery {
+				discoveries[name] = true
+				sources[name] = discoverySource{config: d, refresh: func(ctx context.Context) time.Duration {
+					if err := refreshDiscovery(ctx, d); err != nil && ctx.Err() == nil {
+						log.WithFields(logrus.Fields{"discovery": d.Name, "error": err}).Warn("Discovery failed, keeping previous targets")
+					}
+					return d.refreshInterval()
+				}}
+			}
+			for name, target := range Config.Targets {
+				if target.SRV != "" {
+					sources[srvSource(name)] = discoverySource{config: target, refresh: func(ctx context.Context) time.Duration {
+						return refreshSRV(ctx, target)
+					}}
+				}
+			}
+			cMutex.RUnlock()
+
+			// stop changed and removed sources before dropping their targets,
+			// so a refresh in progress can't bring them back
+			for name, cancel := range cancels {
+				if source, found := sources[name]; !found || !reflect.DeepEqual(source.config, current[name]) {
+					cancel()
+					delete(cancels, name)
+					delete(current, name)
+				}
+			}
+
+			cMutex.Lock()
+			for name := range Config.Discovered {
+				if _, found := sources[name]; !found {
+					delete(Config.Discovered, name)
+				}
+			}
+			for name, s := range Config.Satellites {
+				if s.Discovery != "" && !discoveries[s.Discovery] {
+					delete(Config.Satellites, name)
+				}
+			}
+			cMutex.Unlock()
+			forgetKVSecrets(discoveries)
+
+			for name, source := range sources {
+				if _, found := cancels[name]; found {
+					continue
+				}
+				sourceCtx, cancel := context.WithCancel(ctx)
+				cancels[name] = cancel
+				current[name] = source.config
+
+				running.Add(1)
+				go func() {
+					defer running.Done()
+					refreshSource(sourceCtx, source.refresh)
+				}()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-discoveryChanged:
+			}
+		}
+	}()
+
+	return stopped
+}
+
+// restartDiscovery makes the discovery loop pick up the discoveries and SRV
+// targets of a changed configuration. It doesn't wait for it.
+func restartDiscovery() {
+	select {
+	case discoveryChanged <- struct{}{}:
+	default:
+	}
+}
+
+// refreshSource calls refresh right away and then again whenever it asks for
+// it, until ctx is done.
+func refreshSource(ctx context.Context, refresh func(ctx context.Context) time.Duration) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(refresh(ctx))
+		}
+	}
+}
+
+// allTargets yields the configured and the discovered targets, including
+// the targets expanded from SRV targets. A configured target hides a
+// discovered target of the same name. Callers hold cMutex.
+func (c *Configuration) allTargets() iter.Seq2[string, Target] {
+	return func(yield func(string, Target) bool) {
+		for name, target := range c.Targets {
+			if !yield(name, target) {
+				return
+			}
+		}
+		for _, targets := range c.Discovered {
+			for name, target := range targets {
+				if _, found := c.Targets[name]; found {
+					continue
+				}
+				if !yield(name, target) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// discoveredBy returns the name of the discovery that found target name, or
+// "" for configured targets. Callers hold cMutex.
+func (c *Configuration) discoveredBy(name string) string {
+	if _, found := c.Targets[name]; found {
+		return ""
+	}
+	for discovery, targets := range c.Discovered {
+		if _, found := targets[name]; found {
+			return discovery
+		}
+	}
+	return ""
+}
+
+// validateDiscovery checks a discovery against the configuration c.
+func validateDiscovery(c *Configuration, d DiscoveryConfig) []ConfigError {
+	var errs []ConfigError
+	path := "discovery." + d.Name
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	if err := ValidateIdentifier(d.Name, "discovery name"); err != nil {
+		add(path, err)
+	}
+
+	types := slices.Sorted(maps.Keys(discoveryTypes))
+	switch {
+	case !slices.Contains(types, d.Type):
+		add(path+".type", fmt.Errorf("unknown discovery type %q - valid types are %s", d.Type, strings.Join(types, ", ")))
+	case d.Type == "http" && d.URL == "":
+		add(path+".url", errors.New("url cannot be empty"))
+	case d.Type == "file" && len(d.Files) == 0:
+		add(path+".files", errors.New("files cannot be empty"))
+	case d.Type == "consul" && d.URL == "":
+		add(path+".url", errors.New("url cannot be empty"))
+	}
+	if d.KVPrefix != "" && d.Type != "consul" {
+		add(path+".kv_prefix", errors.New("kv_prefix is only supported for type consul"))
+	}
+
+	if d.RefreshInterval < 0 {
+		add(path+".refresh_interval", errors.New("refresh interval must be positive"))
+	}
+	errs = append(errs, validateProbeDefaults(path, ProbeDefaults{ProbeType: d.ProbeType})...)
+	if _, found := c.TargetTemplates[d.Template]; d.Template != "" && !found {
+		add(path+".template", fmt.Errorf("target template %s is not defined", d.Template))
+	}
+	for _, g := range d.Groups {
+		if err := ValidateIdentifier(g, "group name"); err != nil {
+			add(path+".groups", err)
+		}
+	}
+	for k := range d.Tags {
+		if k == "" || strings.ContainsAny(k, ",=!") {
+			add(path+".tags", fmt.Errorf("invalid tag name %q", k))
+		}
+	}
+
+	return errs
+}
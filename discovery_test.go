@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.yml")
+	err := os.WriteFile(file, []byte(`
+- targets: ["db1.example.com"]
+  labels:
+    role: db
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"targets": ["web1.example.com:443", "web2.example.com:443"], "labels": {"env": "prod", "__scheme__": "https", "__meta_rack": "r1"}}]`))
+	}))
+	defer server.Close()
+
+	cMutex.Lock()
+	Config = Configuration{
+		Discovery: map[string]DiscoveryConfig{
+			"cmdb":  {Name: "cmdb", Type: "http", URL: server.URL, ProbeType: "http", Tags: map[string]string{"env": "staging"}},
+			"files": {Name: "files", Type: "file", Files: []string{filepath.Join(dir, "*.yml")}},
+		},
+	}
+	cMutex.Unlock()
+
+	for _, d := range Config.Discovery {
+		if err := refreshDiscovery(context.Background(), d); err != nil {
+			t.Fatalf("refreshDiscovery(%s) error = %v", d.Name, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		host string
+		tags string
+	}{
+		{"cmdb-web1.example.com-443", "https://web1.example.com:443", "discovery=cmdb,env=staging"},
+		{"cmdb-web2.example.com-443", "https://web2.example.com:443", "discovery=cmdb,env=staging"},
+		{"files-db1.example.com", "db1.example.com", "discovery=files,role=db"},
+	}
+
+	cMutex.RLock()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var found *Target
+			for name, target := range Config.allTargets() {
+				if name == tt.name {
+					found = &target
+				}
+			}
+			if found == nil {
+				t.Fatalf("target %s not discovered", tt.name)
+			}
+			if found.Host != tt.host {
+				t.Errorf("Host = %s, want %s", found.Host, tt.host)
+			}
+			var tags []string
+			for k, v := range found.Tags {
+				tags = append(tags, k+"="+v)
+			}
+			slices.Sort(tags)
+			if got := strings.Join(tags, ","); got != tt.tags {
+				t.Errorf("Tags = %s, want %s", got, tt.tags)
+			}
+			if Config.discoveredBy(tt.name) == "" {
+				t.Errorf("discoveredBy(%s) is empty", tt.name)
+			}
+		})
+	}
+
+	selected := resolveTargets(&Config, Satellite{Name: "sat1", TargetSelectors: []string{"discovery=cmdb"}})
+	cMutex.RUnlock()
+	if len(selected) != 2 {
+		t.Errorf("resolveTargets() = %d targets, want 2", len(selected))
+	}
+
+	failing = true
+	if err := refreshDiscovery(context.Background(), Config.Discovery["cmdb"]); err == nil {
+		t.Errorf("refreshDiscovery() with failing server succeeded")
+	}
+	cMutex.RLock()
+	kept := len(Config.Discovered["cmdb"])
+	cMutex.RUnlock()
+	if kept != 2 {
+		t.Errorf("targets after failed refresh = %d, want 2", kept)
+	}
+}
+
+func TestStartDiscovery(t *testing.T) {
+	// the slow source answers only when its request is cancelled
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"targets": ["web1.example.com"]}]`))
+	}))
+	defer fast.Close()
+
+	cMutex.Lock()
+	Config = Configuration{
+		Discovery: map[string]DiscoveryConfig{
+			"slow": {Name: "slow", Type: "http", URL: slow.URL},
+			"fast": {Name: "fast", Type: "http", URL: fast.URL},
+		},
+	}
+	cMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := startDiscovery(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cMutex.RLock()
+		discovered := len(Config.Discovered["fast"])
+		cMutex.RUnlock()
+		if discovered == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fast discovery held up by the slow one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a changed configuration restarts the discovery, targets of removed
+	// sources are dropped
+	cMutex.Lock()
+	delete(Config.Discovery, "fast")
+	cMutex.Unlock()
+	restartDiscovery()
+
+	for {
+		cMutex.RLock()
+		_, found := Config.Discovered["fast"]
+		cMutex.RUnlock()
+		if !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("targets of removed discovery kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("discovery not stopped")
+	}
+}
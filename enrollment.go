@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultEnrollmentValidity = 24 * time.Hour
+
+// EnrollmentToken allows a single satellite to register itself with the head.
+// Only a hash of the token is stored, it is removed once used.
+type EnrollmentToken struct {
+	Name string `mapstructure:"name"`
+	Hash string `mapstructure:"hash" json:"-"`
+	// Satellite restricts the token to a satellite name, any name is accepted if empty
+	Satellite string   `mapstructure:"satellite,omitempty"`
+	Targets   []string `mapstructure:"targets"`
+	Expires   int64    `mapstructure:"expires"`
+	CreatedBy string   `mapstructure:"created_by"`
+}
+
+type EnrollmentTokenRequestPacket struct {
+	Satellite string   `mapstructure:"satellite"`
+	Targets   []string `mapstructure:"targets"`
+	// ValidFor is a duration like "2h", defaults to DefaultEnrollmentValidity
+	ValidFor string `mapstructure:"valid_for"`
+}
+
+type EnrollmentTokenResponsePacket struct {
+	Name    string `mapstructure:"name"`
+	Token   string `mapstructure:"token"`
+	Expires int64  `mapstructure:"expires"`
+}
+
+type EnrollRequestPacket struct {
+	Name             string `mapstructure:"name"`
+	Token            string `mapstructure:"token"`
+	RequireSignature bool   `mapstructure:"require_signature"`
+}
+
+type EnrollResponsePacket struct {
+	Name    string   `mapstructure:"satellite_name"`
+	Secret  string   `mapstructure:"secret"`
+	Targets []string `mapstructure:"targets"`
+}
+
+func ListEnrollmentTokens(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	tokens := make([]EnrollmentToken, 0, len(Config.Enrollments))
+	for _, t := range Config.Enrollments {
+		tokens = append(tokens, t)
+	}
+	cMutex.RUnlock()
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+
+	err := json.NewEncoder(w).Encode(tokens)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func CreateEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	// CreateEnrollmentToken is behind authMiddleware
+	tokenName := chi.URLParam(r, "name")
+
+	// Validate token name
+	if err := ValidateIdentifier(tokenName, "token name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid token name", err)
+		return
+	}
+
+	var request EnrollmentTokenRequestPacket
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure parsing request. Token not added.", err)
+		return
+	}
+
+	if request.Satellite != "" {
+		if err := ValidateIdentifier(request.Satellite, "satellite name"); err != nil {
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid satellite name", err)
+			return
+		}
+	}
+
+	validFor := DefaultEnrollmentValidity
+	if request.ValidFor != "" {
+		var err error
+		validFor, err = time.ParseDuration(request.ValidFor)
+		if err != nil || validFor <= 0 {
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid validity", err)
+			return
+		}
+	}
+
+	secret := RandomString(32)
+	hash, err := HashSecret(secret)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing token. Token not added.", err)
+		return
+	}
+
+	token := EnrollmentToken{
+		Name:      tokenName,
+		Hash:      hash,
+		Satellite: request.Satellite,
+		Targets:   request.Targets,
+		Expires:   time.Now().Add(validFor).Unix(),
+		CreatedBy: callerFromContext(r.Context()).Name,
+	}
+
+	cMutex.Lock()
+	if _, found := Config.Enrollments[tokenName]; found {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Token already exists", nil)
+		return
+	}
+
+	for _, t := range token.Targets {
+		if _, found := Config.Targets[t]; !found {
+			cMutex.Unlock()
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Target referenced is not defined",
+				fmt.Errorf("target %s not found", t))
+			return
+		}
+	}
+
+	if Config.Enrollments == nil {
+		Config.Enrollments = make(map[string]EnrollmentToken)
+	}
+	Config.Enrollments[tokenName] = token
+
+	err = WriteConfig()
+	if err != nil {
+		delete(Config.Enrollments, tokenName)
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Token not added.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "enrollment_token.create", "enrollment-tokens/"+tokenName, nil, token)
+
+	log.WithFields(logrus.Fields{
+		"token":   tokenName,
+		"expires": time.Unix(token.Expires, 0),
+		"by":      token.CreatedBy,
+	}).Info("Enrollment token created")
+
+	err = json.NewEncoder(w).Encode(EnrollmentTokenResponsePacket{
+		Name:    tokenName,
+		Token:   tokenName + ":" + secret,
+		Expires: token.Expires,
+	})
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func DeleteEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	// DeleteEnrollmentToken is behind authMiddleware
+	tokenName := chi.URLParam(r, "name")
+
+	// Validate token name
+	if err := ValidateIdentifier(tokenName, "token name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid token name", err)
+		return
+	}
+
+	cMutex.Lock()
+	token, found := Config.Enrollments[tokenName]
+	if !found {
+		cMutex.Unlock()
+		handleError(w, http.StatusNotFound, r.RequestURI, "Token not found", nil)
+		return
+	}
+
+	delete(Config.Enrollments, tokenName)
+	err := WriteConfig()
+
+	if err != nil {
+		Config.Enrollments[tokenName] = token
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Token not revoked.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "enrollment_token.delete", "enrollment-tokens/"+tokenName, token, nil)
+}
+
+// EnrollSatellite registers a new satellite presenting a valid enrollment
+// token. The token is consumed and the generated secret returned once.
+func EnrollSatellite(w http.ResponseWriter, r *http.Request) {
+	var request EnrollRequestPacket
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure parsing request", err)
+		return
+	}
+
+	// Validate satellite name
+	if err := ValidateIdentifier(request.Name, "satellite name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid satellite name", err)
+		return
+	}
+
+	tokenName, tokenSecret, _ := strings.Cut(request.Token, ":")
+
+	cMutex.RLock()
+	token, found := Config.Enrollments[tokenName]
+	cMutex.RUnlock()
+
+	if !found || !VerifySecret(tokenSecret, token.Hash) {
+		log.WithFields(logrus.Fields{"satellite": request.Name}).Warn("Enrollment with invalid token")
+		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
+		return
+	}
+
+	if time.Now().Unix() >= token.Expires {
+		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", errors.New("enrollment token expired"))
+		return
+	}
+
+	if token.Satellite != "" && token.Satellite != request.Name {
+		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here",
+			errors.New("enrollment token is not valid for this satellite name"))
+		return
+	}
+
+	secret := RandomString(20)
+	satellite := Satellite{
+		Active:           true,
+		Name:             request.Name,
+		Targets:          token.Targets,
+		RequireSignature: request.RequireSignature,
+	}
+	if err := satellite.setSecret(secret); err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing secret. Satellite not added.", err)
+		return
+	}
+
+	cMutex.Lock()
+	// the token might have been used while we were hashing
+	if _, found := Config.Enrollments[tokenName]; !found {
+		cMutex.Unlock()
+		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", errors.New("enrollment token already used"))
+		return
+	}
+	if _, found := Config.Satellites[request.Name]; found {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Satellite already exists", nil)
+		return
+	}
+
+	if Config.Satellites == nil {
+		Config.Satellites = make(map[string]Satellite)
+	}
+	Config.Satellites[request.Name] = satellite
+	delete(Config.Enrollments, tokenName)
+
+	err := WriteConfig()
+	if err != nil {
+		delete(Config.Satellites, request.Name)
+		Config.Enrollments[tokenName] = token
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Satellite not added.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, "enrollment-token:"+tokenName, "satellite.enroll", "satellites/"+request.Name, nil, satellite.SafeForLogging())
+
+	log.WithFields(logrus.Fields{
+		"satellite": request.Name,
+		"token":     tokenName,
+		"targets":   satellite.Targets,
+	}).Info("Satellite enrolled")
+
+	err = json.NewEncoder(w).Encode(EnrollResponsePacket{
+		Name:    request.Name,
+		Secret:  secret,
+		Targets: satellite.Targets,
+	})
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// enrollSatellite registers the satellite with the head using a one-time
+// token and stores the received secret in secretFile. If secretFile already
+// holds a secret, the satellite is enrolled and nothing is done.
+func enrollSatellite(headUrl string, name string, token string, secretFile string) error {
+	if secretFile == "" {
+		return errors.New("--enroll requires --secret-file to store the credentials")
+	}
+
+	if data, err := os.ReadFile(secretFile); err == nil && len(bytes.TrimSpace(data)) > 0 {
+		log.WithFields(logrus.Fields{"secret_file": secretFile}).Info("Already enrolled, ignoring enrollment token")
+		return nil
+	}
+
+	payload, _ := json.Marshal(EnrollRequestPacket{Name: name, Token: token, RequireSignature: signRequests})
+	request, _ := http.NewRequest("POST", headUrl+"enroll", bytes.NewReader(payload))
+	request.Header.Set(HeaderNprobeVersion, version)
+
+	response, err := satelliteClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		errorMsg, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("head responded with status %d: %s", response.StatusCode, errorMsg)
+	}
+
+	var enrolled EnrollResponsePacket
+	if err := json.NewDecoder(response.Body).Decode(&enrolled); err != nil {
+		return err
+	}
+
+	if err := writeSecretFile(secretFile, enrolled.Secret); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"satellite":   enrolled.Name,
+		"targets":     enrolled.Targets,
+		"secret_file": secretFile,
+	}).Info("Enrolled with head")
+
+	return nil
+}
+
+// writeSecretFile writes secret to file, which is only readable by the owner
+// even if it existed before with other permissions.
+func writeSecretFile(file string, secret string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.WriteString(secret + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
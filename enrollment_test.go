@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestEnrollment(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:   filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{},
+		Targets: map[string]Target{
+			"server1": {Name: "server1", Host: "foo.example.com"},
+		},
+	}
+	cMutex.Unlock()
+
+	// createToken creates an enrollment token as an admin would and returns it
+	createToken := func(name string, body string) (int, string) {
+		r := withNameParam(httptest.NewRequest("PUT", "/enrollment-tokens/x", strings.NewReader(body)), name)
+		r = r.WithContext(context.WithValue(r.Context(), callerContextKey, &Caller{Name: "admin"}))
+		w := httptest.NewRecorder()
+		CreateEnrollmentToken(w, r)
+
+		var packet EnrollmentTokenResponsePacket
+		json.NewDecoder(w.Body).Decode(&packet)
+		return w.Code, packet.Token
+	}
+	enroll := func(name string, token string) int {
+		body, _ := json.Marshal(EnrollRequestPacket{Name: name, Token: token})
+		w := httptest.NewRecorder()
+		EnrollSatellite(w, httptest.NewRequest("POST", "/enroll", strings.NewReader(string(body))))
+		return w.Code
+	}
+
+	if status, _ := createToken("unknown", `{"Targets": ["server9"]}`); status != http.StatusBadRequest {
+		t.Errorf("token with unknown target: status = %d, want 400", status)
+	}
+	if status, _ := createToken("invalid", `{"ValidFor": "soon"}`); status != http.StatusBadRequest {
+		t.Errorf("token with invalid validity: status = %d, want 400", status)
+	}
+
+	_, anyName := createToken("any", `{"Targets": ["server1"]}`)
+	_, restricted := createToken("restricted", `{"Satellite": "sat2"}`)
+	_, expired := createToken("expired", `{}`)
+	cMutex.Lock()
+	e := Config.Enrollments["expired"]
+	e.Expires = time.Now().Unix() - 1
+	Config.Enrollments["expired"] = e
+	cMutex.Unlock()
+
+	tests := []struct {
+		name      string
+		satellite string
+		token     string
+		status    int
+	}{
+		{"invalid token", "sat1", "any:wrong", http.StatusForbidden},
+		{"unknown token", "sat1", "nobody:" + strings.TrimPrefix(anyName, "any:"), http.StatusForbidden},
+		{"expired token", "sat1", expired, http.StatusForbidden},
+		{"restricted to other name", "sat1", restricted, http.StatusForbidden},
+		{"restricted to name", "sat2", restricted, http.StatusOK},
+		{"valid token", "sat1", anyName, http.StatusOK},
+		{"token used a second time", "sat3", anyName, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := enroll(tt.satellite, tt.token); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	cMutex.RLock()
+	sat1, found := Config.Satellites["sat1"]
+	_, tokenLeft := Config.Enrollments["any"]
+	cMutex.RUnlock()
+	if !found || !sat1.Active || strings.Join(sat1.Targets, ",") != "server1" || sat1.SecretHash == "" {
+		t.Errorf("enrolled satellite = %+v, want active with targets of the token and a secret", sat1)
+	}
+	if tokenLeft {
+		t.Errorf("used enrollment token kept")
+	}
+
+	// two satellites racing for the same token, only one of them may enroll
+	_, racing := createToken("racing", `{}`)
+	statuses := make([]int, 2)
+	var wg sync.WaitGroup
+	for i, name := range []string{"sat4", "sat5"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = enroll(name, racing)
+		}()
+	}
+	wg.Wait()
+
+	cMutex.RLock()
+	_, sat4 := Config.Satellites["sat4"]
+	_, sat5 := Config.Satellites["sat5"]
+	cMutex.RUnlock()
+	if statuses[0]+statuses[1] != http.StatusOK+http.StatusForbidden || sat4 == sat5 {
+		t.Errorf("racing enrollments: statuses = %v, enrolled sat4 %v, sat5 %v, want exactly one", statuses, sat4, sat5)
+	}
+}
+
+func TestEnrollSatellite(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	hash, _ := HashSecret("token-secret")
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog: filepath.Join(dir, "audit.log"),
+		Enrollments: map[string]EnrollmentToken{
+			"e1": {Name: "e1", Hash: hash, Expires: time.Now().Add(time.Hour).Unix()},
+		},
+	}
+	cMutex.Unlock()
+
+	router := chi.NewRouter()
+	router.Post("/enroll", EnrollSatellite)
+	head := httptest.NewServer(router)
+	t.Cleanup(head.Close)
+
+	client := satelliteClient
+	satelliteClient = head.Client()
+	t.Cleanup(func() { satelliteClient = client })
+
+	// an existing empty secret file readable by others is not enrolled yet
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := enrollSatellite(head.URL+"/", "sat1", "e1:token-secret", secretFile); err != nil {
+		t.Fatalf("enrollSatellite failed: %v", err)
+	}
+	info, err := os.Stat(secretFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("secret file not written with mode 0600: %v", err)
+	}
+	data, _ := os.ReadFile(secretFile)
+	cMutex.RLock()
+	sat1 := Config.Satellites["sat1"]
+	cMutex.RUnlock()
+	if !VerifySecret(strings.TrimSpace(string(data)), sat1.SecretHash) {
+		t.Errorf("secret file does not hold the secret of the enrolled satellite")
+	}
+
+	// once enrolled the token is not presented again
+	if err := enrollSatellite(head.URL+"/", "sat1", "e1:token-secret", secretFile); err != nil {
+		t.Errorf("enrollSatellite with existing secret failed: %v", err)
+	}
+	if err := enrollSatellite(head.URL+"/", "sat2", "e1:token-secret", filepath.Join(t.TempDir(), "secret")); err == nil {
+		t.Errorf("enrollment with a used token succeeded")
+	}
+}
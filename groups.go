@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// TargetGroupPacket shows the members of a target group and the satellites
+// subscribed to it.
+type TargetGroupPacket struct {
+	Name       string   `mapstructure:"name"`
+	Targets    []string `mapstructure:"targets"`
+	Satellites []string `mapstructure:"satellites"`
+}
+
+// selectorRequirement is one comma separated part of a target selector.
+type selectorRequirement struct {
+	Key    string
+	Value  string
+	Negate bool
+	// Exists is set for requirements without a value ("key" or "!key")
+	Exists bool
+}
+
+// TargetSelector selects targets by their tags. It is a comma separated list
+// of requirements which all have to match: "key=value", "key!=value", "key"
+// (tag is set) and "!key" (tag is not set).
+type TargetSelector []selectorRequirement
+
+// ParseTargetSelector parses a selector like "env=prod,role!=db".
+func ParseTargetSelector(selector string) (TargetSelector, error) {
+	var parsed TargetSelector
+	for _, part := range splitList(selector) {
+		var req selectorRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			req.Key, req.Value, _ = strings.Cut(part, "!=")
+			req.Negate = true
+		case strings.Contains(part, "="):
+			req.Key, req.Value, _ = strings.Cut(part, "=")
+		case strings.HasPrefix(part, "!"):
+			req.Key = part[1:]
+			req.Negate = true
+			req.Exists = true
+		default:
+			req.Key = part
+			req.Exists = true
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" {
+			return nil, fmt.Errorf("selector %q has a requirement without a tag name", selector)
+		}
+		parsed = append(parsed, req)
+	}
+
+	if len(parsed) == 0 {
+		return nil, errors.New("selector cannot be empty")
+	}
+	return parsed, nil
+}
+
+// Matches reports whether tags fulfill all requirements of the selector.
+func (s TargetSelector) Matches(tags map[string]string) bool {
+	for _, req := range s {
+		value, found := tags[req.Key]
+		var match bool
+		if req.Exists {
+			match = found
+		} else {
+			match = found && value == req.Value
+		}
+		if match == req.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriptions returns the targets, target groups and selectors of a
+// satellite including those of its satellite groups. Callers hold cMutex.
+func subscriptions(c *Configuration, satellite Satellite) (targets []string, targetGroups []string, selectors []string) {
+	targets = slices.Clone(satellite.Targets)
+	targetGroups = slices.Clone(satellite.TargetGroups)
+	selectors = slices.Clone(satellite.TargetSelectors)
+	for _, name := range satellite.Groups {
+		g := c.SatelliteGroups[name]
+		targets = append(targets, g.Targets...)
+		targetGroups = append(targetGroups, g.TargetGroups...)
+		selectors = append(selectors, g.TargetSelectors...)
+	}
+	return targets, targetGroups, selectors
+}
+
+// resolveTargets returns the targets of a satellite: the targets it or its
+// satellite groups list, the members of the target groups they subscribe to
+// and the targets matching their selectors. Each target is returned once,
+// listed targets keep their order, the others follow sorted by name. The
+// settings of each target are resolved with resolveTarget. Callers hold
+// cMutex.
+func resolveTargets(c *Configuration, satellite Satellite) []Target {
+	var targets []Target
+	seen := map[string]bool{}
+
+	listed, subscribedGroups, selectorList := subscriptions(c, satellite)
+
+	for _, name := range listed {
+		target, exists := c.Targets[name]
+		if !exists {
+			log.Warnf("Target %s not found for satellite %s, skipping", name, satellite.Name)
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if target.SRV == "" {
+			targets = append(targets, target)
+			continue
+		}
+
+		expanded := slices.Collect(maps.Values(c.Discovered[srvSource(name)]))
+		sort.Slice(expanded, func(i, j int) bool { return expanded[i].Name < expanded[j].Name })
+		for _, t := range expanded {
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+
+	var selectors []TargetSelector
+	for _, s := range selectorList {
+		// selectors are validated with the configuration
+		if selector, err := ParseTargetSelector(s); err == nil {
+			selectors = append(selectors, selector)
+		}
+	}
+
+	var subscribed []Target
+	for name, target := range c.allTargets() {
+		// SRV targets are probed through the targets expanded from them
+		if seen[name] || target.SRV != "" {
+			continue
+		}
+		if slices.ContainsFunc(target.Groups, func(g string) bool { return slices.Contains(subscribedGroups, g) }) ||
+			slices.ContainsFunc(selectors, func(s TargetSelector) bool { return s.Matches(target.Tags) }) {
+			subscribed = append(subscribed, target)
+		}
+	}
+	sort.Slice(subscribed, func(i, j int) bool { return subscribed[i].Name < subscribed[j].Name })
+	targets = append(targets, subscribed...)
+
+	for i := range targets {
+		targets[i] = resolveTarget(c, satellite, targets[i])
+	}
+
+	return targets
+}
+
+// targetGroups returns all target groups. Callers hold cMutex.
+func targetGroups(c *Configuration) map[string]*TargetGroupPacket {
+	groups := map[string]*TargetGroupPacket{}
+	group := func(name string) *TargetGroupPacket {
+		if groups[name] == nil {
+			groups[name] = &TargetGroupPacket{Name: name, Targets: []string{}, Satellites: []string{}}
+		}
+		return groups[name]
+	}
+
+	for name, target := range c.allTargets() {
+		if target.SRV != "" {
+			continue
+		}
+		for _, g := range target.Groups {
+			group(g).Targets = append(group(g).Targets, name)
+		}
+	}
+	for name, satellite := range c.Satellites {
+		_, subscribed, _ := subscriptions(c, satellite)
+		for _, g := range slices.Compact(slices.Sorted(slices.Values(subscribed))) {
+			group(g).Satellites = append(group(g).Satellites, name)
+		}
+	}
+
+	for _, g := range groups {
+		sort.Strings(g.Targets)
+		sort.Strings(g.Satellites)
+	}
+	return groups
+}
+
+// ListTargetGroups returns all target groups with their members and subscribers.
+func ListTargetGroups(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	groups := targetGroups(&Config)
+	cMutex.RUnlock()
+
+	result := make([]TargetGroupPacket, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	err := json.NewEncoder(w).Encode(result)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func GetTargetGroup(w http.ResponseWriter, r *http.Request) {
+	groupName := chi.URLParam(r, "name")
+
+	// Validate group name
+	if err := ValidateIdentifier(groupName, "group name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid group name", err)
+		return
+	}
+
+	cMutex.RLock()
+	group, found := targetGroups(&Config)[groupName]
+	cMutex.RUnlock()
+
+	if !found {
+		handleError(w, http.StatusNotFound, r.RequestURI, "Requested item not found", nil)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(group)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
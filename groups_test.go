@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTargetSelector(t *testing.T) {
+	tags := map[string]string{"env": "prod", "role": "web"}
+
+	tests := []struct {
+		name     string
+		selector string
+		matches  bool
+		wantErr  bool
+	}{
+		{"equal", "env=prod", true, false},
+		{"equal mismatch", "env=dev", false, false},
+		{"all must match", "env=prod, role=db", false, false},
+		{"not equal", "role!=db", true, false},
+		{"not equal on missing tag", "dc!=fra", true, false},
+		{"exists", "role", true, false},
+		{"not exists", "!dc", true, false},
+		{"not exists mismatch", "!env", false, false},
+		{"empty", "", false, true},
+		{"empty key", "=prod", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := ParseTargetSelector(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTargetSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := selector.Matches(tags); got != tt.matches {
+				t.Errorf("Matches() = %v, want %v", got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	c := &Configuration{
+		Targets: map[string]Target{
+			"web1": {Name: "web1", Groups: []string{"web"}, Tags: map[string]string{"env": "prod"}},
+			"web2": {Name: "web2", Groups: []string{"web"}, Tags: map[string]string{"env": "dev"}},
+			"db1":  {Name: "db1", Groups: []string{"db"}, Tags: map[string]string{"env": "prod"}},
+			"dns1": {Name: "dns1"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		satellite Satellite
+		expected  []string
+	}{
+		{"explicit only", Satellite{Targets: []string{"dns1", "web1"}}, []string{"dns1", "web1"}},
+		{"group", Satellite{TargetGroups: []string{"web"}}, []string{"web1", "web2"}},
+		{"selector", Satellite{TargetSelectors: []string{"env=prod"}}, []string{"db1", "web1"}},
+		{"combined without duplicates", Satellite{Targets: []string{"web2"}, TargetGroups: []string{"web"}, TargetSelectors: []string{"env=prod"}}, []string{"web2", "db1", "web1"}},
+		{"unknown group", Satellite{TargetGroups: []string{"mail"}}, nil},
+		{"missing explicit target", Satellite{Targets: []string{"gone"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for _, target := range resolveTargets(c, tt.satellite) {
+				names = append(names, target.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("resolveTargets() = %v, want %v", names, tt.expected)
+			}
+		})
+	}
+
+	groups := targetGroups(c)
+	if len(groups) != 2 || strings.Join(groups["web"].Targets, ",") != "web1,web2" {
+		t.Errorf("targetGroups() = %v", groups)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultHistoryLimit = 50
+
+type ConfigVersionPacket struct {
+	Version int64 `mapstructure:"version"`
+	Current bool  `mapstructure:"current"`
+}
+
+// historyDir returns the directory prior config versions are kept in, by
+// default history/ next to the config file. Callers hold cMutex.
+func historyDir() string {
+	if Config.HistoryDir != "" {
+		return Config.HistoryDir
+	}
+	return filepath.Join(filepath.Dir(ConfigFile), "history")
+}
+
+// historyFile returns the file a version is kept in, it has the extension of the config file.
+func historyFile(version int64) string {
+	return filepath.Join(historyDir(), fmt.Sprintf("config-%d%s", version, historyExt()))
+}
+
+func historyExt() string {
+	if ext := filepath.Ext(ConfigFile); ext != "" {
+		return ext
+	}
+	return ".json"
+}
+
+// configVersions returns the versions kept in the history, oldest first.
+// Callers hold cMutex.
+func configVersions() ([]int64, error) {
+	entries, err := os.ReadDir(historyDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var versions []int64
+	for _, e := range entries {
+		name, found := strings.CutPrefix(e.Name(), "config-")
+		if !found {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.TrimSuffix(name, historyExt()), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// saveConfigHistory copies the config file into the history as the current
+// version and drops the oldest versions beyond the history limit. Nothing is
+// stored if the file did not change since the last saved version. Callers
+// hold cMutex.
+func saveConfigHistory() error {
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(historyDir(), 0700); err != nil {
+		return err
+	}
+
+	versions, err := configVersions()
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		if last, err := os.ReadFile(historyFile(versions[len(versions)-1])); err == nil && bytes.Equal(last, data) {
+			return nil
+		}
+	}
+
+	if err := os.WriteFile(historyFile(Config.Version), data, 0600); err != nil {
+		return err
+	}
+	versions = append(versions, Config.Version)
+
+	limit := Config.HistoryLimit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	for len(versions) > limit {
+		if err := os.Remove(historyFile(versions[0])); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// loadConfigVersion reads a version from the history, resolving its values
+// with resolve, see readConfig. Callers hold cMutex.
+func loadConfigVersion(version int64, resolve referenceResolver) (Configuration, map[string]configReference, []byte, error) {
+	data, err := os.ReadFile(historyFile(version))
+	if err != nil {
+		return Configuration{}, nil, nil, err
+	}
+
+	c, references, err := readConfig(data, configType(ConfigFile), resolve)
+	return c, references, data, err
+}
+
+// loadVersionParam parses a version given in the request and loads it. Only
+// versions that are rolled back need their references resolved.
+func loadVersionParam(w http.ResponseWriter, r *http.Request, param string, resolve referenceResolver) (Configuration, map[string]configReference, []byte, bool) {
+	version, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid config version", err)
+		return Configuration{}, nil, nil, false
+	}
+
+	cMutex.RLock()
+	c, references, data, err := loadConfigVersion(version, resolve)
+	cMutex.RUnlock()
+
+	if errors.Is(err, os.ErrNotExist) {
+		handleError(w, http.StatusNotFound, r.RequestURI, "Config version not found", nil)
+		return c, nil, nil, false
+	}
+	var errs ConfigErrors
+	if errors.As(err, &errs) {
+		handleConfigErrors(w, r.RequestURI, errs)
+		return c, nil, nil, false
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure reading config version", err)
+		return c, nil, nil, false
+	}
+
+	return c, references, data, true
+}
+
+// ListConfigVersions returns the versions kept in the history, newest first.
+// The newest version is the running configuration.
+func ListConfigVersions(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	versions, err := configVersions()
+	cMutex.RUnlock()
+
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure reading config history", err)
+		return
+	}
+
+	result := make([]ConfigVersionPacket, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		result = append(result, ConfigVersionPacket{Version: versions[i], Current: i == len(versions)-1})
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// GetConfigVersion returns a version from the history with secrets masked.
+func GetConfigVersion(w http.ResponseWriter, r *http.Request) {
+	c, _, _, ok := loadVersionParam(w, r, chi.URLParam(r, "version"), nil)
+	if !ok {
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(c.SafeForLogging())
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// DiffConfigVersion returns the changes from a version to the version given
+// by the "to" query parameter, by default to the running configuration.
+func DiffConfigVersion(w http.ResponseWriter, r *http.Request) {
+	from, _, _, ok := loadVersionParam(w, r, chi.URLParam(r, "version"), nil)
+	if !ok {
+		return
+	}
+
+	var to SafeConfiguration
+	if toParam := r.URL.Query().Get("to"); toParam != "" && toParam != "current" {
+		c, _, _, ok := loadVersionParam(w, r, toParam, nil)
+		if !ok {
+			return
+		}
+		to = c.SafeForLogging()
+	} else {
+		cMutex.RLock()
+		to = persistedConfig().SafeForLogging()
+		cMutex.RUnlock()
+	}
+
+	changes := diffConfig(from.SafeForLogging(), to)
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+
+	err := json.NewEncoder(w).Encode(changes)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// RollbackConfig makes a version from the history the running configuration.
+// It is stored as a new version, so the rollback itself can be rolled back.
+// The version is validated like an uploaded configuration. API tokens,
+// enrollment tokens and satellite secrets are kept as they are unless
+// ?credentials=true is given, so revoked credentials don't come back.
+func RollbackConfig(w http.ResponseWriter, r *http.Request) {
+	restored, references, data, ok := loadVersionParam(w, r, chi.URLParam(r, "version"), resolveReference)
+	if !ok {
+		return
+	}
+
+	credentials, _ := strconv.ParseBool(r.URL.Query().Get("credentials"))
+	if !credentials {
+		cMutex.RLock()
+		keepCredentials(&restored, Config)
+		cMutex.RUnlock()
+	}
+
+	if errs := validateConfig(&restored); len(errs) > 0 {
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	if _, err := migrateSatelliteSecrets(&restored, references); err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing satellite secrets", err)
+		return
+	}
+
+	before, after, err := applyConfig(restored, references, data, configType(ConfigFile))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Rollback failed.", err)
+		return
+	}
+
+	action := "config.rollback"
+	if credentials {
+		action = "config.rollback_credentials"
+	}
+	recordConfigAudit(r, action, before, after)
+
+	log.WithFields(logrus.Fields{
+		"from":    before.Version,
+		"to":      chi.URLParam(r, "version"),
+		"version": after.Version,
+	}).Info("Config rolled back")
+}
+
+// keepCredentials replaces the API tokens, enrollment tokens and satellite
+// secrets of c with those of current. Satellites that don't exist in current
+// are left without a secret.
+func keepCredentials(c *Configuration, current Configuration) {
+	c.Tokens = current.Tokens
+	c.Enrollments = current.Enrollments
+
+	for name, s := range c.Satellites {
+		p := current.Satellites[name]
+		s.Secret = ""
+		s.SecretHash = p.SecretHash
+		s.SigningKey = p.SigningKey
+		s.PreviousSecretHash = p.PreviousSecretHash
+		s.PreviousSigningKey = p.PreviousSigningKey
+		s.PreviousSecretExpires = p.PreviousSecretExpires
+		s.PendingSecret = p.PendingSecret
+		s.LastSecretUsed = p.LastSecretUsed
+		c.Satellites[name] = s
+	}
+}
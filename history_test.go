@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestConfigHistory(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:     filepath.Join(dir, "audit.log"),
+		HistoryLimit: 3,
+		Satellites:   map[string]Satellite{},
+	}
+
+	var versions []int64
+	for _, name := range []string{"sat1", "sat2", "sat3", "sat4"} {
+		Config.Satellites[name] = Satellite{Name: name, Active: true}
+		if err := WriteConfig(); err != nil {
+			t.Fatalf("WriteConfig() error = %v", err)
+		}
+		versions = append(versions, Config.Version)
+	}
+
+	kept, err := configVersions()
+	cMutex.Unlock()
+
+	if err != nil {
+		t.Fatalf("configVersions() error = %v", err)
+	}
+	if len(kept) != 3 || kept[0] != versions[1] || kept[2] != versions[3] {
+		t.Errorf("configVersions() = %v, want last 3 of %v", kept, versions)
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i] <= versions[i-1] {
+			t.Errorf("versions not increasing: %v", versions)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		version    int64
+		satellites int
+	}{
+		{"oldest kept", versions[1], 2},
+		{"newest", versions[3], 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _, err := loadConfigVersion(tt.version, nil)
+			if err != nil {
+				t.Fatalf("loadConfigVersion() error = %v", err)
+			}
+			if len(c.Satellites) != tt.satellites {
+				t.Errorf("satellites = %d, want %d", len(c.Satellites), tt.satellites)
+			}
+			if c.Satellites["sat1"].Name != "sat1" {
+				t.Errorf("satellite name not injected")
+			}
+		})
+	}
+
+	if _, _, _, err := loadConfigVersion(versions[0], nil); err == nil {
+		t.Errorf("pruned version %d still loadable", versions[0])
+	}
+
+	// diff of the oldest kept version against the running config
+	r := withURLParam(httptest.NewRequest("GET", "/config/versions/x/diff", nil), "version", versions[1])
+	w := httptest.NewRecorder()
+	DiffConfigVersion(w, r)
+
+	var changes []ConfigChange
+	if err := json.NewDecoder(w.Body).Decode(&changes); err != nil {
+		t.Fatalf("decoding diff: %v", err)
+	}
+	found := map[string]bool{}
+	for _, c := range changes {
+		found[c.Path] = true
+	}
+	if !found["satellites.sat3.name"] || !found["satellites.sat4.name"] || found["satellites.sat1.name"] {
+		t.Errorf("unexpected diff %v", changes)
+	}
+
+	// credentials created after the version survive the rollback
+	cMutex.Lock()
+	Config.Tokens = map[string]APIToken{"reader": {Name: "reader", Hash: "reader-hash", Scopes: []string{ScopeReadOnly}}}
+	sat1 := Config.Satellites["sat1"]
+	sat1.SecretHash = "sat1-hash"
+	Config.Satellites["sat1"] = sat1
+	cMutex.Unlock()
+
+	// roll back to the oldest kept version
+	r = withURLParam(httptest.NewRequest("POST", "/config/rollback/x", nil), "version", versions[1])
+	w = httptest.NewRecorder()
+	RollbackConfig(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("rollback status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(Config.Satellites) != 2 {
+		t.Errorf("satellites after rollback = %d, want 2", len(Config.Satellites))
+	}
+	if _, found := Config.Tokens["reader"]; !found || Config.Satellites["sat1"].SecretHash != "sat1-hash" {
+		t.Errorf("credentials not kept by rollback: %v, %v", Config.Tokens, Config.Satellites["sat1"])
+	}
+	if Config.Version <= versions[3] {
+		t.Errorf("rollback did not create a new version")
+	}
+	reloaded, _, _, err := loadConfigVersion(Config.Version, nil)
+	if err != nil || len(reloaded.Satellites) != 2 {
+		t.Errorf("rolled back config not persisted: %v", err)
+	}
+
+	// credentials are only rolled back on request
+	r = withURLParam(httptest.NewRequest("POST", "/config/rollback/x?credentials=true", nil), "version", versions[1])
+	w = httptest.NewRecorder()
+	RollbackConfig(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("rollback status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(Config.Tokens) != 0 || Config.Satellites["sat1"].SecretHash != "" {
+		t.Errorf("credentials not rolled back: %v, %v", Config.Tokens, Config.Satellites["sat1"])
+	}
+}
+
+// withURLParam adds a chi URL parameter to r, as the router would.
+func withURLParam(r *http.Request, key string, value int64) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, strconv.FormatInt(value, 10))
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// fileReferencePrefix marks a config value that is read from a file.
+const fileReferencePrefix = "file:"
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configReference is a config value referring to environment variables or a
+// file, and the value it resolved to.
+type configReference struct {
+	raw      string
+	resolved string
+}
+
+// configReferences holds the references of the running configuration, keyed
+// by setting. The running configuration holds the resolved values, the
+// references are put back when it is written or shown. Guarded by cMutex.
+var configReferences map[string]configReference
+
+// referenceResolver resolves value, the setting at path of a config.
+type referenceResolver func(path string, value string) (string, error)
+
+// resolveReference resolves the references in the configuration file.
+func resolveReference(path string, value string) (string, error) {
+	return interpolate(value)
+}
+
+// keepReferences returns the resolver for uploaded configurations. They can't
+// add references, which would let API users read environment variables and
+// files of the head, but can keep the references of the running configuration
+// given in references.
+func keepReferences(references map[string]configReference) referenceResolver {
+	return func(path string, value string) (string, error) {
+		if !isReference(value) {
+			return value, nil
+		}
+		if r, found := references[path]; found && r.raw == value {
+			return r.resolved, nil
+		}
+		return "", errReferenceAdded
+	}
+}
+
+var errReferenceAdded = errors.New("references to environment variables and files can only be added in the configuration file")
+
+// isReference reports whether value refers to environment variables or a file.
+func isReference(value string) bool {
+	return envReference.MatchString(value) || strings.HasPrefix(value, fileReferencePrefix)
+}
+
+// checkReferences returns an error if value, the setting at path as converted
+// by configValue, holds a reference that isn't one of references. Values set
+// through the API would otherwise be resolved once the written configuration
+// is read again.
+func checkReferences(path string, value interface{}, references map[string]configReference) error {
+	switch v := value.(type) {
+	case string:
+		if r, found := references[path]; isReference(v) && (!found || r.raw != v) {
+			return ConfigError{Path: path, Err: errReferenceAdded}
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			if err := checkReferences(path+"."+strings.ToLower(key), item, references); err != nil {
+				return err
+			}
+		}
+	case map[string]map[string]interface{}:
+		for key, item := range v {
+			if err := checkReferences(path+"."+strings.ToLower(key), item, references); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if err := checkReferences(fmt.Sprintf("%s.%d", path, i), item, references); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configType returns the viper config type for a config file, based on its extension.
+func configType(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// contentConfigType returns the viper config type for an uploaded config, based on its Content-Type.
+func contentConfigType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return "yaml"
+	case "application/toml", "text/toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// interpolate resolves references in a config value: ${VAR} is replaced by
+// the environment variable VAR, a value starting with "file:" is replaced by
+// the content of the file, without trailing whitespace.
+func interpolate(value string) (string, error) {
+	var missing []string
+	value = envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	if file, found := strings.CutPrefix(value, fileReferencePrefix); found {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimRight(string(data), " \t\r\n")
+	}
+
+	return value, nil
+}
+
+// interpolateConfig resolves the values read by v with resolve and sets the
+// resolved values as overrides. It returns the values that changed.
+func interpolateConfig(v *viper.Viper, resolve referenceResolver) (map[string]configReference, error) {
+	references := make(map[string]configReference)
+	var errs ConfigErrors
+	for _, key := range v.AllKeys() {
+		switch value := v.Get(key).(type) {
+		case string:
+			resolved, err := resolve(key, value)
+			if err != nil {
+				errs = append(errs, ConfigError{Path: key, Err: err})
+				continue
+			}
+			if resolved != value {
+				v.Set(key, resolved)
+				references[key] = configReference{raw: value, resolved: resolved}
+			}
+		case []interface{}:
+			resolved := make([]interface{}, len(value))
+			for i, item := range value {
+				resolved[i] = item
+				if s, ok := item.(string); ok {
+					path := fmt.Sprintf("%s.%d", key, i)
+					r, err := resolve(path, s)
+					if err != nil {
+						errs = append(errs, ConfigError{Path: path, Err: err})
+						continue
+					}
+					if r != s {
+						references[path] = configReference{raw: s, resolved: r}
+					}
+					resolved[i] = r
+				}
+			}
+			v.Set(key, resolved)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return references, nil
+}
+
+// withReferences returns a copy of c with the references put back in place of
+// the values they resolved to. Values changed since they were resolved are
+// kept. Maps and slices along the way are copied, c itself is not modified.
+func withReferences(c Configuration, references map[string]configReference) Configuration {
+	v := reflect.ValueOf(&c).Elem()
+	for path, r := range references {
+		if restored, ok := restoreReference(v, strings.Split(path, "."), r); ok {
+			v.Set(restored)
+		}
+	}
+	return c
+}
+
+// restoreReference returns a copy of v with the string at path, matched
+// against mapstructure tags and map keys like viper does, set to the raw
+// reference if it still holds the resolved value.
+func restoreReference(v reflect.Value, path []string, r configReference) (reflect.Value, bool) {
+	if len(path) == 0 {
+		if v.Kind() == reflect.String && v.String() == r.resolved {
+			return reflect.ValueOf(r.raw).Convert(v.Type()), true
+		}
+		return v, false
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, false
+		}
+		return restoreReference(v.Elem(), path, r)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			rest := path[1:]
+			if options == "squash" {
+				rest = path
+			} else if name == "-" || !strings.EqualFold(name, path[0]) {
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			restored, ok := restoreReference(v.Field(i), rest, r)
+			if !ok {
+				continue
+			}
+			out := reflect.New(v.Type()).Elem()
+			out.Set(v)
+			out.Field(i).Set(restored)
+			return out, true
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return v, false
+		}
+		for _, key := range v.MapKeys() {
+			if !strings.EqualFold(key.String(), path[0]) {
+				continue
+			}
+			restored, ok := restoreReference(v.MapIndex(key), path[1:], r)
+			if !ok {
+				return v, false
+			}
+			out := reflect.MakeMapWithSize(v.Type(), v.Len())
+			for _, k := range v.MapKeys() {
+				out.SetMapIndex(k, v.MapIndex(k))
+			}
+			out.SetMapIndex(key, restored)
+			return out, true
+		}
+	case reflect.Slice:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= v.Len() {
+			return v, false
+		}
+		restored, ok := restoreReference(v.Index(i), path[1:], r)
+		if !ok {
+			return v, false
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(out, v)
+		out.Index(i).Set(restored)
+		return out, true
+	}
+	return v, false
+}
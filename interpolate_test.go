@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("NPROBE_TEST_TOKEN", "s3cret")
+	t.Setenv("NPROBE_TEST_DIR", t.TempDir())
+	secretFile := filepath.Join(os.Getenv("NPROBE_TEST_DIR"), "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{"plain", "foo.example.com", "foo.example.com", false},
+		{"env", "${NPROBE_TEST_TOKEN}", "s3cret", false},
+		{"env within value", "Token ${NPROBE_TEST_TOKEN}!", "Token s3cret!", false},
+		{"missing env", "${NPROBE_TEST_UNSET}", "", true},
+		{"no reference", "$NPROBE_TEST_TOKEN", "$NPROBE_TEST_TOKEN", false},
+		{"file", "file:" + secretFile, "from-file", false},
+		{"file with env", "file:${NPROBE_TEST_DIR}/secret", "from-file", false},
+		{"missing file", "file:" + secretFile + ".missing", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := interpolate(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("interpolate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("interpolate() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadConfigFormats(t *testing.T) {
+	t.Setenv("NPROBE_TEST_HOST", "foo.example.com")
+
+	tests := []struct {
+		name   string
+		typ    string
+		config string
+	}{
+		{"json", "json", `{"authorization": "admin", "satellites": {"sat1": {"targets": ["server1"]}}, "targets": {"server1": {"host": "${NPROBE_TEST_HOST}", "probe_type": "http"}}}`},
+		{"yaml", "yaml", "authorization: admin\nsatellites:\n  sat1:\n    targets: [server1]\ntargets:\n  server1:\n    host: ${NPROBE_TEST_HOST}\n    probe_type: http\n"},
+		{"toml", "toml", "authorization = \"admin\"\n[satellites.sat1]\ntargets = [\"server1\"]\n[targets.server1]\nhost = \"${NPROBE_TEST_HOST}\"\nprobe_type = \"http\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, err := readConfig([]byte(tt.config), tt.typ, resolveReference)
+			if err != nil {
+				t.Fatalf("readConfig() error = %v", err)
+			}
+			if errs := validateConfig(&c); len(errs) > 0 {
+				t.Errorf("validateConfig() = %v", errs)
+			}
+			if c.Authorization != "admin" || c.Targets["server1"].Host != "foo.example.com" || c.Targets["server1"].ProbeType != "http" {
+				t.Errorf("config not read correctly: %+v", c)
+			}
+		})
+	}
+}
+
+func TestConfigReferences(t *testing.T) {
+	t.Setenv("NPROBE_TEST_HOST", "foo.example.com")
+	t.Setenv("NPROBE_TEST_TOKEN", "s3cret")
+
+	config := `{"satellites": {"sat1": {"targets": ["server1", "${NPROBE_TEST_HOST}"]}},
+		"discovery": {"consul": {"type": "consul", "url": "http://consul:8500", "token": "${NPROBE_TEST_TOKEN}"}},
+		"targets": {"server1": {"host": "${NPROBE_TEST_HOST}"}, "server2": {"host": "${NPROBE_TEST_HOST}"}}}`
+	c, references, err := readConfig([]byte(config), "json", resolveReference)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	if len(references) != 4 {
+		t.Errorf("references = %v, want 4", references)
+	}
+
+	// changed values are kept, the others get their reference back
+	server2 := c.Targets["server2"]
+	server2.Host = "bar.example.com"
+	c.Targets["server2"] = server2
+
+	raw := withReferences(c, references)
+	if raw.Targets["server1"].Host != "${NPROBE_TEST_HOST}" || raw.Targets["server2"].Host != "bar.example.com" ||
+		raw.Discovery["consul"].Token != "${NPROBE_TEST_TOKEN}" || raw.Satellites["sat1"].Targets[1] != "${NPROBE_TEST_HOST}" {
+		t.Errorf("references not restored: %+v", raw)
+	}
+	if c.Targets["server1"].Host != "foo.example.com" || c.Satellites["sat1"].Targets[1] != "foo.example.com" {
+		t.Errorf("withReferences() modified the config: %+v", c)
+	}
+
+	// uploads can keep the references of the running config but not add new ones
+	resolve := keepReferences(references)
+	kept, _, err := readConfig([]byte(config), "json", resolve)
+	if err != nil || kept.Discovery["consul"].Token != "s3cret" {
+		t.Errorf("kept references not resolved: %v", err)
+	}
+	for _, upload := range []string{
+		`{"targets": {"server3": {"host": "${NPROBE_TEST_HOST}"}}}`,
+		`{"targets": {"server1": {"host": "file:/etc/passwd"}}}`,
+	} {
+		if _, _, err := readConfig([]byte(upload), "json", resolve); err == nil {
+			t.Errorf("reference added by upload %s", upload)
+		}
+	}
+
+	// nor can values set through the API
+	server2.Host = "file:/etc/passwd"
+	c.Targets["server2"] = server2
+	if err := checkReferences("targets", configSection(withReferences(c, references).Targets), references); err == nil {
+		t.Errorf("added reference not detected")
+	}
+}
+
+func TestSatelliteSecretReference(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+	t.Setenv("NPROBE_TEST_SECRET", "s3cret")
+
+	config := `{"audit_log": "` + filepath.Join(dir, "audit.log") + `",
+		"satellites": {"sat1": {"secret": "${NPROBE_TEST_SECRET}", "targets": ["server1"], "active": true}},
+		"targets": {"server1": {"host": "foo.example.com"}}}`
+	if err := os.WriteFile(ConfigFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cMutex.Lock()
+	Config = Configuration{}
+	configFileFingerprint = ""
+	cMutex.Unlock()
+
+	if _, _, _, err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+
+	// the secret is hashed for authentication, the file keeps the reference
+	cMutex.RLock()
+	sat1 := Config.Satellites["sat1"]
+	cMutex.RUnlock()
+	if !VerifySecret("s3cret", sat1.SecretHash) {
+		t.Errorf("referenced secret not hashed")
+	}
+	written := func() string {
+		data, err := os.ReadFile(ConfigFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if !strings.Contains(written(), "${NPROBE_TEST_SECRET}") {
+		t.Errorf("reference replaced on start: %s", written())
+	}
+
+	// nor is it lost by a config write or a round trip through the API
+	cMutex.Lock()
+	err := WriteConfig()
+	cMutex.Unlock()
+	if err != nil || !strings.Contains(written(), "${NPROBE_TEST_SECRET}") {
+		t.Errorf("reference replaced on write: %v, %s", err, written())
+	}
+
+	w := httptest.NewRecorder()
+	ConfigGet(w, httptest.NewRequest("GET", "/config", nil))
+	w2 := httptest.NewRecorder()
+	ConfigUpload(w2, httptest.NewRequest("PUT", "/config", strings.NewReader(w.Body.String())))
+	if w2.Code != 200 || !strings.Contains(written(), "${NPROBE_TEST_SECRET}") {
+		t.Errorf("reference replaced on upload: %d %s, %s", w2.Code, w2.Body.String(), written())
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/subtle"
-	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,31 +14,61 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // Configuration represents the application settings, including database, server, debug, and monitoring configurations.
 type Configuration struct {
-	Authorization string               `mapstructure:"authorization"`
-	Database      InfluxConfiguration  `mapstructure:"database"`
-	Debug         bool                 `mapstructure:"debug"`
-	ListenIP      string               `mapstructure:"listen_ip"`
-	ListenPort    string               `mapstructure:"listen_port"`
-	Privileged    bool                 `mapstructure:"privileged"`
-	Satellites    map[string]Satellite `mapstructure:"satellites"`
-	Targets       map[string]Target    `mapstructure:"targets"`
-	Version       int64                `mapstructure:"version"`
+	// AuditLog is the file administrative changes are appended to, defaults to audit.log next to the config file
+	AuditLog      string              `mapstructure:"audit_log"`
+	Authorization string              `mapstructure:"authorization"`
+	Database      InfluxConfiguration `mapstructure:"database"`
+	Debug         bool                `mapstructure:"debug"`
+	// Discovery are the sources of discovered targets
+	Discovery map[string]DiscoveryConfig `mapstructure:"discovery"`
+	// Discovered are the targets found by discovery, keyed by discovery name
+	Discovered map[string]map[string]Target `mapstructure:"-"`
+	ListenIP   string                       `mapstructure:"listen_ip"`
+	ListenPort string                       `mapstructure:"listen_port"`
+	Privileged bool                         `mapstructure:"privileged"`
+	Satellites map[string]Satellite         `mapstructure:"satellites"`
+	// SatelliteGroups share targets and probe defaults between satellites
+	SatelliteGroups map[string]SatelliteGroup `mapstructure:"satellite_groups"`
+	Targets         map[string]Target         `mapstructure:"targets"`
+	// TargetTemplates are probe settings shared by targets, see Target.Template
+	TargetTemplates map[string]ProbeDefaults   `mapstructure:"target_templates"`
+	TLS             TLSConfiguration           `mapstructure:"tls"`
+	Tokens          map[string]APIToken        `mapstructure:"tokens"`
+	Enrollments     map[string]EnrollmentToken `mapstructure:"enrollment_tokens"`
+	// HistoryDir keeps prior config versions, defaults to history/ next to the config file
+	HistoryDir string `mapstructure:"history_dir"`
+	// HistoryLimit is the number of config versions kept, defaults to DefaultHistoryLimit
+	HistoryLimit int   `mapstructure:"history_limit"`
+	Version      int64 `mapstructure:"version"`
+}
+
+// TLSConfiguration holds the certificates the head serves with. If ClientCAFile
+// is set, client certificates signed by that CA are verified and can be used to
+// authenticate satellites.
+type TLSConfiguration struct {
+	CertFile          string `mapstructure:"cert_file" json:"cert_file"`
+	KeyFile           string `mapstructure:"key_file" json:"key_file"`
+	ClientCAFile      string `mapstructure:"client_ca_file" json:"client_ca_file"`
+	RequireClientCert bool   `mapstructure:"require_client_cert" json:"require_client_cert"`
 }
 
 type InfluxConfiguration struct {
@@ -59,12 +90,30 @@ type ErrorPacket struct {
 }
 
 type Satellite struct {
-	Active   bool      `mapstructure:"active"`
-	Name     string    `mapstructure:"name"`
-	Secret   string    `mapstructure:"secret"`
-	Targets  []string  `mapstructure:"targets"`
-	LastData time.Time `mapstructure:"last_data" json:"-"`
-	Health   bool      `mapstructure:"health" json:"-"`
+	Active     bool   `mapstructure:"active"`
+	Name       string `mapstructure:"name"`
+	Secret     string `mapstructure:"secret,omitempty"`
+	SecretHash string `mapstructure:"secret_hash" json:"-"`
+	SigningKey string `mapstructure:"signing_key" json:"-"`
+	// secret rotation, see RotateSatelliteSecret
+	PreviousSecretHash    string   `mapstructure:"previous_secret_hash,omitempty" json:"-"`
+	PreviousSigningKey    string   `mapstructure:"previous_signing_key,omitempty" json:"-"`
+	PreviousSecretExpires int64    `mapstructure:"previous_secret_expires,omitempty" json:"-"`
+	PendingSecret         string   `mapstructure:"pending_secret,omitempty" json:"-"`
+	LastSecretUsed        string   `mapstructure:"last_secret_used,omitempty" json:"-"`
+	Targets               []string `mapstructure:"targets"`
+	TargetGroups          []string `mapstructure:"target_groups,omitempty"`
+	TargetSelectors       []string `mapstructure:"target_selectors,omitempty"`
+	Groups                []string `mapstructure:"groups,omitempty"`
+	// Overrides change targets for this satellite, keyed by target name
+	Overrides        map[string]TargetOverride `mapstructure:"overrides,omitempty"`
+	RequireSignature bool                      `mapstructure:"require_signature,omitempty"`
+	CertificateAuth  string                    `mapstructure:"certificate_auth,omitempty"`
+	CertificateNames []string                  `mapstructure:"certificate_names,omitempty"`
+	LastData         time.Time                 `mapstructure:"-" json:"-"`
+	Health           bool                      `mapstructure:"-" json:"-"`
+	// Discovery is the discovery the satellite was read from, it is not written to the config file
+	Discovery string `mapstructure:"-" json:"-"`
 }
 
 type SatelliteConfig struct {
@@ -94,15 +143,24 @@ type Probe struct {
 	Loss      float64   `mapstructure:"loss"`
 	NumProbes int       `mapstructure:"num_probes"`
 	Timestamp time.Time `mapstructure:"timestamp"`
+	// Lag is how late the probe started after its scheduled tick, in
+	// milliseconds. Not set for probes that weren't scheduled, e.g. imported ones.
+	Lag *float64 `mapstructure:"lag"`
 }
 
 type Target struct {
-	Name      string `mapstructure:"name"`
-	Host      string `mapstructure:"host"`
-	ProbeType string `mapstructure:"probe_type"`
-	Probes    int    `mapstructure:"probes"`
-	Interval  int    `mapstructure:"interval"`
-	BatchSize int    `mapstructure:"batch_size"`
+	Name      string            `mapstructure:"name"`
+	Host      string            `mapstructure:"host"`
+	ProbeType string            `mapstructure:"probe_type"`
+	Probes    int               `mapstructure:"probes"`
+	Interval  int               `mapstructure:"interval"`
+	BatchSize int               `mapstructure:"batch_size"`
+	Groups    []string          `mapstructure:"groups,omitempty"`
+	Tags      map[string]string `mapstructure:"tags,omitempty"`
+	// Template provides the probe settings the target doesn't set
+	Template string `mapstructure:"template,omitempty"`
+	// SRV expands the target into one target per SRV record instead of Host
+	SRV string `mapstructure:"srv,omitempty"`
 }
 
 type Worker struct {
@@ -161,6 +219,16 @@ func (ss *SecureString) Destroy() {
 	ss.data = nil
 }
 
+// Set replaces the value, zeroing the previous one
+func (ss *SecureString) Set(s string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i := range ss.data {
+		ss.data[i] = 0
+	}
+	ss.data = []byte(s)
+}
+
 // IsEmpty checks if the SecureString is empty
 func (ss *SecureString) IsEmpty() bool {
 	ss.mu.RLock()
@@ -170,15 +238,24 @@ func (ss *SecureString) IsEmpty() bool {
 
 // SafeConfiguration is used for safe logging that masks sensitive data
 type SafeConfiguration struct {
-	Authorization string                    `json:"authorization"`
-	Database      SafeInfluxConfiguration   `json:"database"`
-	Debug         bool                      `json:"debug"`
-	ListenIP      string                    `json:"listen_ip"`
-	ListenPort    string                    `json:"listen_port"`
-	Privileged    bool                      `json:"privileged"`
-	Satellites    map[string]SafeSatellite  `json:"satellites"`
-	Targets       map[string]Target         `json:"targets"`
-	Version       int64                     `json:"version"`
+	AuditLog        string                     `json:"audit_log"`
+	Authorization   string                     `json:"authorization"`
+	Database        SafeInfluxConfiguration    `json:"database"`
+	Debug           bool                       `json:"debug"`
+	Discovery       map[string]DiscoveryConfig `json:"discovery"`
+	ListenIP        string                     `json:"listen_ip"`
+	ListenPort      string                     `json:"listen_port"`
+	Privileged      bool                       `json:"privileged"`
+	Satellites      map[string]SafeSatellite   `json:"satellites"`
+	SatelliteGroups map[string]SatelliteGroup  `json:"satellite_groups"`
+	Targets         map[string]Target          `json:"targets"`
+	TargetTemplates map[string]ProbeDefaults   `json:"target_templates"`
+	TLS             TLSConfiguration           `json:"tls"`
+	Tokens          map[string]APIToken        `json:"tokens"`
+	Enrollments     map[string]EnrollmentToken `json:"enrollment_tokens"`
+	HistoryDir      string                     `json:"history_dir"`
+	HistoryLimit    int                        `json:"history_limit"`
+	Version         int64                      `json:"version"`
 }
 
 type SafeInfluxConfiguration struct {
@@ -189,17 +266,30 @@ type SafeInfluxConfiguration struct {
 }
 
 type SafeSatellite struct {
-	Active   bool      `json:"active"`
-	Name     string    `json:"name"`
-	Secret   string    `json:"secret"` // masked value
-	Targets  []string  `json:"targets"`
-	LastData time.Time `json:"-"`
-	Health   bool      `json:"-"`
+	Active            bool                      `json:"active"`
+	Name              string                    `json:"name"`
+	SecretFingerprint string                    `json:"secret_fingerprint"` // instead of the secret hash
+	Targets           []string                  `json:"targets"`
+	TargetGroups      []string                  `json:"target_groups,omitempty"`
+	TargetSelectors   []string                  `json:"target_selectors,omitempty"`
+	Groups            []string                  `json:"groups,omitempty"`
+	Overrides         map[string]TargetOverride `json:"overrides,omitempty"`
+	RequireSignature  bool                      `json:"require_signature"`
+	CertificateAuth   string                    `json:"certificate_auth"`
+	CertificateNames  []string                  `json:"certificate_names"`
+	// secret rotation state
+	PreviousSecretExpires int64     `json:"previous_secret_expires,omitempty"`
+	RotationPending       bool      `json:"rotation_pending"`
+	LastSecretUsed        string    `json:"last_secret_used"`
+	LastData              time.Time `json:"-"`
+	Health                bool      `json:"-"`
+	Discovery             string    `json:"discovery,omitempty"`
 }
 
 // SafeForLogging returns a configuration struct with all secrets masked
 func (c Configuration) SafeForLogging() SafeConfiguration {
 	safe := SafeConfiguration{
+		AuditLog:      c.AuditLog,
 		Authorization: maskSecret(c.Authorization),
 		Database: SafeInfluxConfiguration{
 			Host:   c.Database.Host,
@@ -207,30 +297,70 @@ func (c Configuration) SafeForLogging() SafeConfiguration {
 			Org:    c.Database.Org,
 			Bucket: c.Database.Bucket,
 		},
-		Debug:      c.Debug,
-		ListenIP:   c.ListenIP,
-		ListenPort: c.ListenPort,
-		Privileged: c.Privileged,
-		Satellites: make(map[string]SafeSatellite),
-		Targets:    c.Targets,
-		Version:    c.Version,
+		Debug:           c.Debug,
+		Discovery:       make(map[string]DiscoveryConfig),
+		ListenIP:        c.ListenIP,
+		ListenPort:      c.ListenPort,
+		Privileged:      c.Privileged,
+		Satellites:      make(map[string]SafeSatellite),
+		SatelliteGroups: c.SatelliteGroups,
+		Targets:         c.Targets,
+		TargetTemplates: c.TargetTemplates,
+		TLS:             c.TLS,
+		Tokens:          c.Tokens,
+		Enrollments:     c.Enrollments,
+		HistoryDir:      c.HistoryDir,
+		HistoryLimit:    c.HistoryLimit,
+		Version:         c.Version,
 	}
 
 	// Mask satellite secrets
 	for name, sat := range c.Satellites {
-		safe.Satellites[name] = SafeSatellite{
-			Active:   sat.Active,
-			Name:     sat.Name,
-			Secret:   maskSecret(sat.Secret),
-			Targets:  sat.Targets,
-			LastData: sat.LastData,
-			Health:   sat.Health,
+		safe.Satellites[name] = sat.SafeForLogging()
+	}
+	for name, d := range c.Discovery {
+		if d.Token != "" {
+			d.Token = maskSecret(d.Token)
 		}
+		safe.Discovery[name] = d
 	}
 
 	return safe
 }
 
+// SafeForLogging returns the satellite with its secrets masked
+func (sat Satellite) SafeForLogging() SafeSatellite {
+	return SafeSatellite{
+		Active:                sat.Active,
+		Name:                  sat.Name,
+		SecretFingerprint:     fingerprintSecret(sat.SecretHash),
+		Targets:               sat.Targets,
+		TargetGroups:          sat.TargetGroups,
+		TargetSelectors:       sat.TargetSelectors,
+		Groups:                sat.Groups,
+		Overrides:             sat.Overrides,
+		RequireSignature:      sat.RequireSignature,
+		CertificateAuth:       sat.CertificateAuth,
+		CertificateNames:      sat.CertificateNames,
+		PreviousSecretExpires: sat.PreviousSecretExpires,
+		RotationPending:       sat.PendingSecret != "",
+		LastSecretUsed:        sat.LastSecretUsed,
+		LastData:              sat.LastData,
+		Health:                sat.Health,
+		Discovery:             sat.Discovery,
+	}
+}
+
+// fingerprintSecret returns a short fingerprint of a stored secret hash. It
+// reveals nothing about the secret but shows whether it changed.
+func fingerprintSecret(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(hash))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
 // maskSecret returns a masked version of a secret string
 func maskSecret(secret string) string {
 	if secret == "" {
@@ -277,6 +407,10 @@ var Config Configuration
 var ConfigFile string
 var Client influxdb2.Client
 var log *logrus.Logger
+var signRequests bool
+var satelliteSecret = NewSecureString("")
+var secretRotationUrl string
+var satelliteClient = &http.Client{Timeout: DefaultSatelliteTimeout}
 var buildtime = ""
 var built = func() string {
 	if info, ok := debug.ReadBuildInfo(); ok {
@@ -307,11 +441,19 @@ const HeaderNprobeVersion = "X-Nprobe-Version"
 const HeaderNprobeApiVersion = "X-Nprobe-Api-Version"
 const HeaderNprobeConfig = "X-Nprobe-Config"
 const HeaderNprobePayloadHash = "X-Nprobe-Hash"
+const HeaderNprobeTimestamp = "X-Nprobe-Timestamp"
+const HeaderNprobeNonce = "X-Nprobe-Nonce"
+const HeaderNprobeSignature = "X-Nprobe-Signature"
+const HeaderNprobeSecretRotation = "X-Nprobe-Secret-Rotation"
 
 const DefaultProbeType = "icmp"
 const DefaultBatchSize = 5
 const DefaultProbes = 5
 const DefaultInterval = 30
+const DefaultSatelliteTimeout = 15 * time.Second
+const DefaultSecretGracePeriod = 24 * time.Hour
+const DefaultMaxProbes = 10
+const DefaultShutdownTimeout = 30 * time.Second
 
 func main() {
 
@@ -327,6 +469,18 @@ func main() {
 		FullTimestamp: true,
 	})
 
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-smokeping" {
+		os.Exit(importSmokepingCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-rrd" {
+		os.Exit(importRRDCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		fmt.Println(err)
@@ -335,12 +489,24 @@ func main() {
 
 	configFile := flag.String("config", "config/config.json", "config file")
 	debugMode := flag.Bool("debug", false, "enable debug mode")
+	enrollToken := flag.String("enroll", "", "enroll with the head using a one-time token, requires --secret-file")
 	headNode := flag.String("head", "", "fqdn / ip of head node")
+	flag.StringVar(&headKeyFile, "head-key-file", "", "file holding the key the head seals signing keys with (default head.key next to the config file)")
+	caFile := flag.String("ca-file", "", "CA certificate(s) to verify the head against")
 	insecureTls := flag.Bool("insecure-tls", false, "disable use of tls cert checking")
+	maxProbes := flag.Int("max-probes", DefaultMaxProbes, "probes running at once, 0 for no limit")
+	maxPps := flag.Float64("max-pps", 0, "packets per second all probes may send, 0 for no limit")
 	mode := flag.String("mode", "satellite", "head / satellite")
 	notls := flag.Bool("notls", false, "disable use of tls")
 	privileged := flag.Bool("privileged", false, "enable privileged mode")
+	pins := flag.String("pin-sha256", "", "comma separated base64 SHA-256 pins of the head's public key")
 	probeName := flag.String("name", hostname, "name of probe")
+	secretFile := flag.String("secret-file", "", "file holding the satellite secret, updated on secret rotation")
+	flag.StringVar(&spoolDir, "spool-dir", defaultSpoolDir(), "directory for results not submitted when stopping, only accessible by the user, empty to discard them")
+	tlsCert := flag.String("tls-cert", "", "client certificate presented to the head")
+	tlsKey := flag.String("tls-key", "", "key of the client certificate")
+	timeout := flag.Duration("timeout", DefaultSatelliteTimeout, "timeout for requests to the head")
+	flag.BoolVar(&signRequests, "sign-requests", false, "sign requests to the head instead of sending the secret")
 
 	flag.Parse()
 
@@ -364,10 +530,19 @@ func main() {
 		"mode":    *mode,
 	}).Info("nprobe is starting")
 
+	// SIGINT and SIGTERM stop head and satellite gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// a second signal stops immediately
+		<-ctx.Done()
+		stop()
+	}()
+
 	if *mode == "head" {
 
 		parseConfig(configFile)
-		ConfigFile = *configFile
+		watchConfig(ctx)
+		discoveryStopped := startDiscovery(ctx)
 
 		// Override InfluxDB token from environment variable if set
 		if envToken := os.Getenv("INFLUXDB_TOKEN"); envToken != "" {
@@ -382,7 +557,6 @@ func main() {
 
 		if Config.Database.Host != "" {
 			Client = influxdb2.NewClient(Config.Database.Host, Config.Database.Token)
-			defer Client.Close()
 		} else {
 			log.Warn("No Database configuration")
 		}
@@ -401,25 +575,97 @@ func main() {
 			router.Get("/healthz", HealthRequest)
 			router.Get("/satellites/{name}", GetSatellite)
 			router.Get("/satellites/{name}/targets", GetTargets)
+			router.Get("/satellites/{name}/secret", GetSatelliteSecret)
 			router.Put("/satellites/{name}/{target}/metrics", SubmitTarget)
+			router.Post("/enroll", EnrollSatellite)
 			router.Get("/version", VersionRequest)
 		})
 
 		// Private Routes
-		// Require Authentication
+		// Require Authentication and the scope noted per route
 		router.Group(func(router chi.Router) {
 			router.Use(authMiddleware)
-			router.Get("/config", ConfigGet)
-			router.Post("/config", ConfigReload)
-			router.Put("/config", ConfigUpload)
-			router.Patch("/satellites/{name}", UpdateSatellite)
-			router.Put("/satellites/{name}", CreateSatellite)
-			router.Delete("/satellites/{name}", DeleteSatellite)
-			//router.Patch("/targets/{name}", UpdateTarget)
-			//router.Put("/targets/{name}", CreateTarget)
-			//router.Delete("/targets/{name}", DeleteTarget)
+
+			router.With(requireScope(ScopeReadOnly)).Get("/config", ConfigGet)
+			router.With(requireScope(ScopeReadOnly)).Get("/audit", AuditGet)
+			router.With(requireScope(ScopeConfigAdmin)).Post("/config", ConfigReload)
+			router.With(requireScope(ScopeConfigAdmin)).Put("/config", ConfigUpload)
+			router.With(requireScope(ScopeReadOnly)).Get("/config/versions", ListConfigVersions)
+			router.With(requireScope(ScopeReadOnly)).Get("/config/versions/{version}", GetConfigVersion)
+			router.With(requireScope(ScopeReadOnly)).Get("/config/versions/{version}/diff", DiffConfigVersion)
+			router.With(requireScope(ScopeConfigAdmin)).Post("/config/rollback/{version}", RollbackConfig)
+
+			router.With(requireScope(ScopeSatelliteAdmin)).Patch("/satellites/{name}", UpdateSatellite)
+			router.With(requireScope(ScopeSatelliteAdmin)).Put("/satellites/{name}", CreateSatellite)
+			router.With(requireScope(ScopeSatelliteAdmin)).Delete("/satellites/{name}", DeleteSatellite)
+			router.With(requireScope(ScopeSatelliteAdmin)).Post("/satellites/{name}/secret", RotateSatelliteSecret)
+			router.With(requireScope(ScopeSatelliteAdmin)).Get("/enrollment-tokens", ListEnrollmentTokens)
+			router.With(requireScope(ScopeSatelliteAdmin)).Put("/enrollment-tokens/{name}", CreateEnrollmentToken)
+			router.With(requireScope(ScopeSatelliteAdmin)).Delete("/enrollment-tokens/{name}", DeleteEnrollmentToken)
+			router.With(requireScope(ScopeReadOnly)).Get("/satellite-groups", ListSatelliteGroups)
+			router.With(requireScope(ScopeReadOnly)).Get("/satellite-groups/{name}", GetSatelliteGroup)
+			router.With(requireScope(ScopeSatelliteAdmin)).Put("/satellite-groups/{name}", PutSatelliteGroup)
+			router.With(requireScope(ScopeSatelliteAdmin)).Patch("/satellite-groups/{name}", PutSatelliteGroup)
+			router.With(requireScope(ScopeSatelliteAdmin)).Delete("/satellite-groups/{name}", DeleteSatelliteGroup)
+
+			router.With(requireScope(ScopeReadOnly)).Get("/targets", ListTargets)
+			router.With(requireScope(ScopeReadOnly)).Get("/targets/{name}", GetTarget)
+			router.With(requireScope(ScopeReadOnly)).Get("/target-groups", ListTargetGroups)
+			router.With(requireScope(ScopeReadOnly)).Get("/target-groups/{name}", GetTargetGroup)
+			router.With(requireScope(ScopeTargetAdmin)).Patch("/targets/{name}", UpdateTarget)
+			router.With(requireScope(ScopeTargetAdmin)).Put("/targets/{name}", CreateTarget)
+			router.With(requireScope(ScopeTargetAdmin)).Delete("/targets/{name}", DeleteTarget)
+
+			router.With(requireScope(ScopeConfigAdmin)).Get("/tokens", ListTokens)
+			router.With(requireScope(ScopeConfigAdmin)).Put("/tokens/{name}", CreateToken)
+			router.With(requireScope(ScopeConfigAdmin)).Delete("/tokens/{name}", DeleteToken)
 		})
-		log.Fatal(http.ListenAndServe(Config.ListenIP+":"+Config.ListenPort, router))
+
+		server := &http.Server{
+			Addr:    Config.ListenIP + ":" + Config.ListenPort,
+			Handler: router,
+		}
+
+		if Config.TLS.CertFile != "" {
+			server.TLSConfig, err = headTLSConfig(Config.TLS)
+			if err != nil {
+				log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid TLS configuration")
+			}
+			log.WithFields(logrus.Fields{
+				"client_ca":           Config.TLS.ClientCAFile,
+				"require_client_cert": Config.TLS.RequireClientCert,
+			}).Info("Serving TLS")
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			<-ctx.Done()
+			log.Info("Shutting down. Draining requests.")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.WithFields(logrus.Fields{"error": err}).Error("Failed to drain requests")
+			}
+		}()
+
+		if Config.TLS.CertFile != "" {
+			err = server.ListenAndServeTLS(Config.TLS.CertFile, Config.TLS.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+		<-drained
+		<-discoveryStopped
+
+		if Client != nil {
+			log.Info("Flushing database writes")
+			// closing the client flushes its write APIs
+			Client.Close()
+		}
+		log.Info("Head stopped")
 	} else {
 		// Validate probe name before using it in URLs
 		if err := ValidateIdentifier(*probeName, "probe name"); err != nil {
@@ -432,22 +678,52 @@ func main() {
 		}
 
 		headUrl = headUrl + *headNode + "/"
+		secretRotationUrl = headUrl + "satellites/" + *probeName + "/secret"
 
-		request, _ := http.NewRequest("GET", headUrl+"satellites/"+*probeName+"/targets", nil)
-		request.Header.Set(HeaderAuthorization, os.Getenv("NPROBE_SECRET"))
+		if *insecureTls {
+			log.Warn("TLS certificate verification of the head is disabled")
+		}
 
-		t := &http.Transport{}
+		if *maxProbes < 0 || *maxPps < 0 {
+			log.Fatal("--max-probes and --max-pps can't be negative")
+		}
+		satellitePool = newProbePool(*maxProbes, *maxPps)
+
+		tlsConfig, err := satelliteTLSConfig(SatelliteTLSOptions{
+			InsecureSkipVerify: *insecureTls,
+			CAFile:             *caFile,
+			Pins:               splitList(*pins),
+			CertFile:           *tlsCert,
+			KeyFile:            *tlsKey,
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid TLS settings")
+		}
 
-		if !*insecureTls {
-			t = &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
+		satelliteClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+			Timeout: *timeout,
+		}
+
+		if *enrollToken != "" {
+			if err := enrollSatellite(headUrl, *probeName, *enrollToken, *secretFile); err != nil {
+				log.WithFields(logrus.Fields{"error": err}).Fatal("Enrollment failed")
 			}
 		}
-		client := &http.Client{Transport: t, Timeout: 15 * time.Second}
 
-		response, err := client.Do(request)
+		if err := loadSatelliteSecret(*secretFile); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Fatal("Error loading secret")
+		}
+
+		request, _ := http.NewRequest("GET", headUrl+"satellites/"+*probeName+"/targets", nil)
+		if err := authorizeRequest(request, nil); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Fatal("Error signing request")
+		}
+
+		response, err := satelliteClient.Do(request)
 		if err != nil {
 			log.WithFields(logrus.Fields{"error": err}).Fatal("Error retrieving configuration from head")
 		} else {
@@ -481,6 +757,8 @@ func main() {
 				"targets": targets,
 			}).Infof("Targets received")
 
+			checkSecretRotation(response)
+
 			if headConfigVersion, err := strconv.Atoi(response.Header.Get(HeaderNprobeConfig)); err == nil {
 				Config.Version = int64(headConfigVersion)
 			} else {
@@ -489,6 +767,16 @@ func main() {
 
 			log.Debug("Configuration received")
 
+			ctx, cancel := context.WithCancelCause(ctx)
+			defer cancel(nil)
+			stopSatellite = cancel
+
+			submissions.Add(1)
+			go func() {
+				defer submissions.Done()
+				submitSpool(ctx, headUrl, *probeName)
+			}()
+
 			workerChan := make(chan *Worker, len(targets))
 			i := 0
 			for _, k := range targets {
@@ -503,15 +791,19 @@ func main() {
 					"target":    wk.Target.Name,
 					"type":      wk.Target.ProbeType,
 				}).Info("Launching worker")
-				go wk.HandleProbe(workerChan)
+				// the workers are spread over their interval by their schedule
+				go wk.HandleProbe(ctx, workerChan)
 				i++
-				// put a few seconds in between starting the worker
-				time.Sleep(5 * time.Second)
 			}
 
 			// read the channel, it will block until something is written, then a new
-			// goroutine will start
-			for wk := range workerChan {
+			// goroutine will start unless the satellite is stopping
+			for running := len(targets); running > 0; {
+				wk := <-workerChan
+				if ctx.Err() != nil {
+					running--
+					continue
+				}
 				// log the error
 				log.WithFields(logrus.Fields{
 					"worker id": wk.Id,
@@ -521,23 +813,44 @@ func main() {
 				// reset err
 				wk.Err = nil
 				// a goroutine has ended, restart it
-				go wk.HandleProbe(workerChan)
+				go wk.HandleProbe(ctx, workerChan)
 			}
+
+			log.Info("Shutting down. Waiting for submissions.")
+			submissions.Wait()
+			log.WithFields(logrus.Fields{"cause": context.Cause(ctx)}).Info("Satellite stopped")
 		}
 	}
 }
 
-func ConfigReload(_ http.ResponseWriter, r *http.Request) {
+// ConfigReload re-reads the configuration file. If it is invalid the running
+// configuration is kept and the problems are returned.
+func ConfigReload(w http.ResponseWriter, r *http.Request) {
 	log.Infof("Config Reload triggered")
-	cMutex.Lock()
-	parseConfig(&ConfigFile)
-	cMutex.Unlock()
+
+	before, after, changed, err := reloadConfig()
+	if err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			handleConfigErrors(w, r.RequestURI, errs)
+			return
+		}
+		handleError(w, http.StatusUnprocessableEntity, r.RequestURI, "Failure reading config file. Config not reloaded.", err)
+		return
+	}
+
+	if !changed {
+		log.Info("Config file unchanged, keeping running config")
+		return
+	}
+
+	recordConfigAudit(r, "config.reload", before, after)
 }
 
 func ConfigGet(w http.ResponseWriter, r *http.Request) {
 	log.Infof("Config Get requested")
 	cMutex.RLock()
-	safeConfig := Config.SafeForLogging()
+	safeConfig := persistedConfig().SafeForLogging()
 	cMutex.RUnlock()
 
 	err := json.NewEncoder(w).Encode(safeConfig)
@@ -547,45 +860,108 @@ func ConfigGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ConfigUpload replaces the running configuration. The uploaded config is
+// validated first, with "dry_run=true" only the changes it would make are
+// returned. References to environment variables and files are not resolved,
+// only those of the running configuration can be kept. Credentials hidden or
+// masked by ConfigGet are kept as well.
 func ConfigUpload(w http.ResponseWriter, r *http.Request) {
 	log.Infof("Config Upload started")
 
-	viper.SetConfigType("json")
-	err := viper.ReadConfig(r.Body)
-
+	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		handleError(w, http.StatusServiceUnavailable, r.RequestURI, "Error while encoding targets", err)
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure reading config", err)
+		return
 	}
 
-	var uploadedConfig Configuration
-	err = viper.Unmarshal(&uploadedConfig)
+	typ := contentConfigType(r.Header.Get("Content-Type"))
+	cMutex.RLock()
+	resolve := keepReferences(configReferences)
+	cMutex.RUnlock()
+	uploadedConfig, references, err := readConfig(data, typ, resolve)
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Fatal("Error while unmarshalling")
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			handleConfigErrors(w, r.RequestURI, errs)
+			return
+		}
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure parsing config", err)
+		return
 	}
 
-	cMutex.Lock()
-	Config = uploadedConfig
+	cMutex.RLock()
+	errs := keepHiddenCredentials(&uploadedConfig, references, Config)
+	cMutex.RUnlock()
+	if errs = append(errs, validateConfig(&uploadedConfig)...); len(errs) > 0 {
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
 
-	// set Version of config file to NOW
-	now := time.Now()
-	Config.Version = now.Unix()
-	viper.Set("Version", Config.Version)
+	if _, err := migrateSatelliteSecrets(&uploadedConfig, references); err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing satellite secrets", err)
+		return
+	}
 
-	err = viper.WriteConfigAs(ConfigFile)
-	cMutex.Unlock()
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		cMutex.RLock()
+		before := persistedConfig().SafeForLogging()
+		cMutex.RUnlock()
+
+		after := withReferences(uploadedConfig, references).SafeForLogging()
+		after.Version = before.Version
+
+		changes := diffConfig(before, after)
+		if changes == nil {
+			changes = []ConfigChange{}
+		}
+
+		err := json.NewEncoder(w).Encode(changes)
+
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Error()
+		}
+		return
+	}
+
+	before, after, err := applyConfig(uploadedConfig, references, data, typ)
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Errorf("Error while writing config file")
-	} else {
-		log.Infof("New config (version %d) stored", Config.Version)
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Config not replaced.", err)
+		return
 	}
+
+	recordConfigAudit(r, "config.upload", before, after)
 }
 
 func WriteConfig() error {
-	now := time.Now()
-	Config.Version = now.Unix()
+	// references are written instead of the values they resolved to, satellites
+	// read from discovery stay at their source
+	persisted := persistedConfig()
+	sections := map[string]map[string]map[string]interface{}{
+		"satellites":        configSection(configuredSatellites(persisted.Satellites)),
+		"discovery":         configSection(persisted.Discovery),
+		"satellite_groups":  configSection(persisted.SatelliteGroups),
+		"targets":           configSection(persisted.Targets),
+		"target_templates":  configSection(persisted.TargetTemplates),
+		"tokens":            configSection(persisted.Tokens),
+		"enrollment_tokens": configSection(persisted.Enrollments),
+	}
+	for key, section := range sections {
+		if err := checkReferences(key, section, configReferences); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Error("Refusing to write config")
+			return err
+		}
+	}
+
+	// versions have to change on every write, satellites compare them to notice new configs
+	version := time.Now().Unix()
+	if version <= Config.Version {
+		version = Config.Version + 1
+	}
+	Config.Version = version
 	viper.Set("Version", Config.Version)
-	viper.Set("satellites", Config.Satellites)
-	viper.Set("targets", Config.Targets)
+	for key, section := range sections {
+		viper.Set(key, section)
+	}
 
 	err := viper.WriteConfigAs(ConfigFile)
 	if err != nil {
@@ -595,6 +971,14 @@ func WriteConfig() error {
 		log.Infof("New config (version %d) stored", Config.Version)
 	}
 
+	if err := rememberConfigFile(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Error while reading back config file")
+	}
+
+	if err := saveConfigHistory(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Error while storing config history")
+	}
+
 	return nil
 }
 
@@ -609,6 +993,7 @@ func GetSatellite(w http.ResponseWriter, r *http.Request) {
 
 	cMutex.RLock()
 	satellite, found := Config.Satellites[satelliteName]
+	active := satelliteActive(&Config, satellite)
 	cMutex.RUnlock()
 
 	if !found {
@@ -616,11 +1001,14 @@ func GetSatellite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if SecureCompareStrings(r.Header.Get(HeaderAuthorization), satellite.Secret) {
+	if credential, err := authenticateSatellite(r, satellite); err == nil {
+		recordSecretUse(w, satelliteName, credential)
 
 		sJson, _ := json.Marshal(satellite)
 		var sConfig SatelliteConfig
 		json.Unmarshal([]byte(sJson), &sConfig)
+		// satellites in a paused group are reported inactive
+		sConfig.Active = active
 		err := json.NewEncoder(w).Encode(sConfig)
 
 		if err != nil {
@@ -628,6 +1016,7 @@ func GetSatellite(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	} else {
+		log.WithFields(logrus.Fields{"satellite": satelliteName, "error": err}).Warn("Satellite authentication failed")
 		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
 		return
 	}
@@ -664,8 +1053,22 @@ func CreateSatellite(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(logrus.Fields{"satelliteStruct": satelliteStruct}).Debug()
 	satelliteStruct.Name = satelliteName
 
-	if satelliteStruct.Secret == "" {
-		satelliteStruct.Secret = RandomString(20)
+	cMutex.RLock()
+	errs := validateSatellite(&Config, satelliteStruct)
+	cMutex.RUnlock()
+	if len(errs) > 0 {
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	secret := satelliteStruct.Secret
+	if secret == "" {
+		secret = RandomString(20)
+	}
+
+	if err := satelliteStruct.setSecret(secret); err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing secret. Satellite not added.", err)
+		return
 	}
 
 	// Acquire lock before modifying Config
@@ -682,10 +1085,12 @@ func CreateSatellite(w http.ResponseWriter, r *http.Request) {
 	}
 	cMutex.Unlock()
 
+	recordAudit(r, auditActor(r), "satellite.create", "satellites/"+satelliteName, nil, satelliteStruct.SafeForLogging())
+
 	retSatelliteConfig := SatelliteCreateResponsePacket{
 		Name:   satelliteStruct.Name,
 		Active: satelliteStruct.Active,
-		Secret: satelliteStruct.Secret,
+		Secret: secret,
 	}
 
 	err = json.NewEncoder(w).Encode(retSatelliteConfig)
@@ -714,7 +1119,17 @@ func UpdateSatellite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var satelliteStruct Satellite
+	if satellite.Discovery != "" {
+		handleError(w, http.StatusConflict, r.RequestURI, "Satellite is discovered and read-only",
+			fmt.Errorf("satellite was read from discovery %s", satellite.Discovery))
+		return
+	}
+
+	var satelliteStruct struct {
+		Satellite
+		// RequireSignature is only changed if given
+		RequireSignature *bool
+	}
 	err := json.NewDecoder(r.Body).Decode(&satelliteStruct)
 
 	if err != nil {
@@ -725,11 +1140,44 @@ func UpdateSatellite(w http.ResponseWriter, r *http.Request) {
 
 	log.WithFields(logrus.Fields{"satelliteStruct": satelliteStruct}).Debug()
 
+	previous := satellite
 	satellite.Active = satelliteStruct.Active
 	satellite.Targets = satelliteStruct.Targets
+	// subscriptions are only replaced if given, an empty list removes them
+	if satelliteStruct.TargetGroups != nil {
+		satellite.TargetGroups = satelliteStruct.TargetGroups
+	}
+	if satelliteStruct.TargetSelectors != nil {
+		satellite.TargetSelectors = satelliteStruct.TargetSelectors
+	}
+	if satelliteStruct.Groups != nil {
+		satellite.Groups = satelliteStruct.Groups
+	}
+	if satelliteStruct.Overrides != nil {
+		satellite.Overrides = satelliteStruct.Overrides
+	}
+	if satelliteStruct.RequireSignature != nil {
+		satellite.RequireSignature = *satelliteStruct.RequireSignature
+	}
+
+	cMutex.RLock()
+	errs := validateSatellite(&Config, satellite)
+	cMutex.RUnlock()
+	// satellites hashed before signing keys were derived need their secret again
+	if satellite.RequireSignature && satellite.SigningKey == "" && satelliteStruct.Secret == "" {
+		errs = append(errs, ConfigError{Path: "satellites." + satelliteName + ".require_signature",
+			Err: errors.New("no signing key, set the secret again to derive one")})
+	}
+	if len(errs) > 0 {
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
 
 	if satelliteStruct.Secret != "" {
-		satellite.Secret = satelliteStruct.Secret
+		if err := satellite.setSecret(satelliteStruct.Secret); err != nil {
+			handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing secret. Satellite not updated.", err)
+			return
+		}
 	}
 
 	// Acquire lock before modifying Config
@@ -748,6 +1196,8 @@ func UpdateSatellite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "satellite.update", "satellites/"+satelliteName, previous.SafeForLogging(), satellite.SafeForLogging())
 }
 
 func DeleteSatellite(w http.ResponseWriter, r *http.Request) {
@@ -769,6 +1219,12 @@ func DeleteSatellite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if satelliteStruct.Discovery != "" {
+		handleError(w, http.StatusConflict, r.RequestURI, "Satellite is discovered and read-only",
+			fmt.Errorf("satellite was read from discovery %s", satelliteStruct.Discovery))
+		return
+	}
+
 	cMutex.Lock()
 	delete(Config.Satellites, satelliteName)
 	err := WriteConfig()
@@ -780,9 +1236,12 @@ func DeleteSatellite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "satellite.delete", "satellites/"+satelliteName, satelliteStruct.SafeForLogging(), nil)
 }
 
 func CreateTarget(w http.ResponseWriter, r *http.Request) {
+	// CreateTarget is behind authMiddleware
 	targetName := chi.URLParam(r, "name")
 
 	// Validate target name
@@ -791,15 +1250,6 @@ func CreateTarget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cMutex.Lock()
-	_, found := Config.Targets[targetName]
-	cMutex.Unlock()
-
-	if found {
-		handleError(w, http.StatusBadRequest, r.RequestURI, "Target already exists", nil)
-		return
-	}
-
 	var targetStruct Target
 	err := json.NewDecoder(r.Body).Decode(&targetStruct)
 
@@ -812,17 +1262,162 @@ func CreateTarget(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(logrus.Fields{"targetStruct": targetStruct}).Debug()
 	targetStruct.Name = targetName
 
+	cMutex.Lock()
+	if _, found := Config.Targets[targetName]; found {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Target already exists", nil)
+		return
+	}
+
+	if discovery := Config.discoveredBy(targetName); discovery != "" {
+		cMutex.Unlock()
+		handleError(w, http.StatusConflict, r.RequestURI, "Target is discovered and read-only",
+			fmt.Errorf("target was found by discovery %s", discovery))
+		return
+	}
+
+	if errs := validateTarget(&Config, targetStruct); len(errs) > 0 {
+		cMutex.Unlock()
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	if Config.Targets == nil {
+		Config.Targets = make(map[string]Target)
+	}
 	Config.Targets[targetName] = targetStruct
-	log.WithFields(logrus.Fields{"Config after appending new target": Config}).Debug()
+	log.WithFields(logrus.Fields{"Config after appending new target": Config.SafeForLogging()}).Debug()
 
-	cMutex.Lock()
 	err = WriteConfig()
 	if err != nil {
 		delete(Config.Targets, targetName)
+		cMutex.Unlock()
 		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Target not added.", nil)
 		return
 	}
 	cMutex.Unlock()
+	// SRV targets are expanded by the discovery loop
+	restartDiscovery()
+
+	recordAudit(r, auditActor(r), "target.create", "targets/"+targetName, nil, targetStruct)
+}
+
+func UpdateTarget(w http.ResponseWriter, r *http.Request) {
+	// UpdateTarget is behind authMiddleware
+	targetName := chi.URLParam(r, "name")
+
+	// Validate target name
+	if err := ValidateIdentifier(targetName, "target name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid target name", err)
+		return
+	}
+
+	cMutex.RLock()
+	target, found := Config.Targets[targetName]
+	discovery := Config.discoveredBy(targetName)
+	cMutex.RUnlock()
+
+	if discovery != "" {
+		handleError(w, http.StatusConflict, r.RequestURI, "Target is discovered and read-only",
+			fmt.Errorf("target was found by discovery %s", discovery))
+		return
+	}
+
+	if !found {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Target not found", nil)
+		return
+	}
+
+	// fields not part of the request are kept, tags are only replaced if
+	// given, an empty object removes them
+	previous := target
+	target.Tags = nil
+	err := json.NewDecoder(r.Body).Decode(&target)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure parsing request. Target not updated.", nil)
+		return
+	}
+
+	log.WithFields(logrus.Fields{"target": target}).Debug()
+	target.Name = targetName
+	if target.Tags == nil {
+		target.Tags = previous.Tags
+	}
+
+	cMutex.Lock()
+	if errs := validateTarget(&Config, target); len(errs) > 0 {
+		cMutex.Unlock()
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	Config.Targets[targetName] = target
+
+	log.WithFields(logrus.Fields{
+		"target": target.Name,
+		"Config": Config.SafeForLogging(),
+	}).Debugf("Config after updating target")
+
+	err = WriteConfig()
+	if err != nil {
+		Config.Targets[targetName] = previous
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Target not updated.", nil)
+		return
+	}
+	cMutex.Unlock()
+	restartDiscovery()
+
+	recordAudit(r, auditActor(r), "target.update", "targets/"+targetName, previous, target)
+}
+
+func DeleteTarget(w http.ResponseWriter, r *http.Request) {
+	// DeleteTarget is behind authMiddleware
+	targetName := chi.URLParam(r, "name")
+
+	// Validate target name
+	if err := ValidateIdentifier(targetName, "target name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid target name", err)
+		return
+	}
+
+	cMutex.Lock()
+	target, found := Config.Targets[targetName]
+	if !found {
+		discovery := Config.discoveredBy(targetName)
+		cMutex.Unlock()
+		if discovery != "" {
+			handleError(w, http.StatusConflict, r.RequestURI, "Target is discovered and read-only",
+				fmt.Errorf("target was found by discovery %s", discovery))
+			return
+		}
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Target not found", nil)
+		return
+	}
+
+	delete(Config.Targets, targetName)
+
+	// satellites and enrollment tokens may still refer to the target
+	if errs := validateConfig(&Config); len(errs) > 0 {
+		Config.Targets[targetName] = target
+		cMutex.Unlock()
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	err := WriteConfig()
+	if err != nil {
+		Config.Targets[targetName] = target
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Target not removed.", nil)
+		return
+	}
+	cMutex.Unlock()
+	restartDiscovery()
+
+	recordAudit(r, auditActor(r), "target.delete", "targets/"+targetName, target, nil)
 }
 
 func GetTargets(w http.ResponseWriter, r *http.Request) {
@@ -844,49 +1439,38 @@ func GetTargets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !SecureCompareStrings(r.Header.Get(HeaderAuthorization), satellite.Secret) {
+	credential, err := authenticateSatellite(r, satellite)
+	if err != nil {
 		cMutex.RUnlock()
+		log.WithFields(logrus.Fields{"satellite": satelliteName, "error": err}).Warn("Satellite authentication failed")
 		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
 		return
 	}
 
-	if !satellite.Active {
+	if !satelliteActive(&Config, satellite) {
 		cMutex.RUnlock()
 		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here",
 			errors.New("satellite marked inactive"))
 		return
 	}
 
-	if len(satellite.Targets) == 0 {
-		cMutex.RUnlock()
+	targets := resolveTargets(&Config, satellite)
+	cMutex.RUnlock()
+
+	if len(targets) == 0 {
 		msg := "no targets for satellite configured"
 		handleError(w, http.StatusServiceUnavailable, r.RequestURI, msg, errors.New(msg))
 		return
 	}
 
-	var targets = make([]Target, len(satellite.Targets))
-	var i = 0
-
-	for _, k := range satellite.Targets {
-		target, exists := Config.Targets[k]
-		if !exists {
-			log.Warnf("Target %s not found for satellite %s, skipping", k, satelliteName)
-			continue
-		}
-		targets[i] = target
-		i++
-	}
-	cMutex.RUnlock()
-
-	// Resize targets slice if some were skipped
-	targets = targets[:i]
+	recordSecretUse(w, satelliteName, credential)
 
 	log.WithFields(logrus.Fields{
 		"satellite": satellite.Name,
 		"targets":   targets,
 	}).Debugf("Satellite is receiving targets")
 
-	err := json.NewEncoder(w).Encode(targets)
+	err = json.NewEncoder(w).Encode(targets)
 
 	if err != nil {
 		handleError(w, http.StatusServiceUnavailable, r.RequestURI, "Error while encoding targets", err)
@@ -911,6 +1495,7 @@ func SubmitTarget(w http.ResponseWriter, r *http.Request) {
 
 	cMutex.Lock()
 	satellite, found := Config.Satellites[satelliteName]
+	active := satelliteActive(&Config, satellite)
 	cMutex.Unlock()
 
 	if !found {
@@ -919,10 +1504,13 @@ func SubmitTarget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !SecureCompareStrings(r.Header.Get(HeaderAuthorization), satellite.Secret) {
+	credential, err := authenticateSatellite(r, satellite)
+	if err != nil {
+		log.WithFields(logrus.Fields{"satellite": satelliteName, "error": err}).Warn("Satellite authentication failed")
 		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
 		return
 	}
+	recordSecretUse(w, satelliteName, credential)
 
 	// we've authorized the request, now we parse the json
 	var responsePacket ResponsePacket
@@ -930,7 +1518,7 @@ func SubmitTarget(w http.ResponseWriter, r *http.Request) {
 
 	log.WithFields(logrus.Fields{"responsePacket": responsePacket}).Debug()
 
-	if !satellite.Active {
+	if !active {
 		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here - satellite is marked inactive", nil)
 		return
 	}
@@ -972,22 +1560,34 @@ func writeData(responsePacket ResponsePacket) {
 		writeAPI := Client.WriteAPI(dbOrg, dbBucket)
 		// create point using fluent style
 
-		for _, probe := range responsePacket.Probes {
-			p := influxdb2.NewPointWithMeasurement("stat").
-				AddTag("unit", "milliseconds").
-				AddTag("target", responsePacket.TargetName+" ("+responsePacket.ProbeType+")").
-				AddTag("probe", responsePacket.SatelliteName).
-				AddField("stddev", probe.StdDev).
-				AddField("median", probe.Median).
-				AddField("max", probe.MaxRTT).
-				AddField("min", probe.MinRTT).
-				AddField("loss", probe.Loss).
-				SetTime(probe.Timestamp)
+		for _, p := range probePoints(responsePacket) {
 			writeAPI.WritePoint(p)
 		}
 	}
 }
 
+// probePoints returns the InfluxDB points of the probes of responsePacket.
+func probePoints(responsePacket ResponsePacket) []*write.Point {
+	points := make([]*write.Point, 0, len(responsePacket.Probes))
+	for _, probe := range responsePacket.Probes {
+		p := influxdb2.NewPointWithMeasurement("stat").
+			AddTag("unit", "milliseconds").
+			AddTag("target", responsePacket.TargetName+" ("+responsePacket.ProbeType+")").
+			AddTag("probe", responsePacket.SatelliteName).
+			AddField("stddev", probe.StdDev).
+			AddField("median", probe.Median).
+			AddField("max", probe.MaxRTT).
+			AddField("min", probe.MinRTT).
+			AddField("loss", probe.Loss).
+			SetTime(probe.Timestamp)
+		if probe.Lag != nil {
+			p.AddField("lag", *probe.Lag)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
 func handleError(w http.ResponseWriter, status int, source string, title string, err error) {
 	log.WithFields(logrus.Fields{
 		"error": err,
@@ -1006,6 +1606,24 @@ func handleError(w http.ResponseWriter, status int, source string, title string,
 	http.Error(w, string(e[:]), status)
 }
 
+// handleConfigErrors responds with one error per problem found in a config.
+func handleConfigErrors(w http.ResponseWriter, source string, errs []ConfigError) {
+	log.WithFields(logrus.Fields{"errors": len(errs)}).Error("Configuration invalid")
+
+	errorResponse := ErrorResponse{}
+	for _, err := range errs {
+		errorResponse.Errors = append(errorResponse.Errors, &ErrorPacket{
+			Status: strconv.Itoa(http.StatusUnprocessableEntity),
+			Source: source,
+			Title:  "Configuration invalid",
+			Detail: err.Error()})
+	}
+
+	e, _ := json.Marshal(errorResponse)
+
+	http.Error(w, string(e[:]), http.StatusUnprocessableEntity)
+}
+
 func commonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		dumpRequest(r)
@@ -1023,14 +1641,15 @@ func commonMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// authMiddleware identifies the caller by the legacy authorization or an API
+// token and stores it in the request context. Scopes are checked per route by
+// requireScope.
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cMutex.RLock()
-		configAuth := Config.Authorization
-		cMutex.RUnlock()
+		caller := identifyCaller(r)
 
-		if SecureCompareStrings(r.Header.Get(HeaderAuthorization), configAuth) {
-			next.ServeHTTP(w, r)
+		if caller != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey, caller)))
 		} else {
 			handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
 			return
@@ -1043,17 +1662,7 @@ func HealthRequest(w http.ResponseWriter, r *http.Request) {
 	msg := "Health Check not ok"
 	var err error
 
-	authHeader := r.Header.Get(HeaderAuthorization)
-	authedRequest := false
-
-	// Read authorization for comparison
-	cMutex.RLock()
-	configAuth := Config.Authorization
-	cMutex.RUnlock()
-
-	if SecureCompareStrings(authHeader, configAuth) {
-		authedRequest = true
-	}
+	authedRequest := identifyCaller(r).HasScope(ScopeReadOnly)
 
 	if Client != nil {
 		health, err := Client.Health(context.Background())
@@ -1079,17 +1688,12 @@ func HealthRequest(w http.ResponseWriter, r *http.Request) {
 	cMutex.RLock()
 	// check each satellite
 	for _, k := range Config.Satellites {
-		if k.Active {
+		if satelliteActive(&Config, k) {
 			last := k.LastData
 
 			// find interval
 			interval := math.MaxInt64
-			for _, t := range k.Targets {
-				s, exists := Config.Targets[t]
-				if !exists {
-					log.Warnf("Target %s not found for satellite %s", t, k.Name)
-					continue
-				}
+			for _, s := range resolveTargets(&Config, k) {
 				if s.Interval < interval {
 					interval = s.Interval
 				}
@@ -1151,62 +1755,23 @@ func parseConfig(configPtr *string) {
 		viper.Set("Verbose", true)
 	}
 	viper.SetConfigFile(*configPtr) // name of config file (without extension)
-	viper.SetConfigType("json")
-	err := viper.ReadInConfig() // Find and read the config file
-
-	if err != nil { // Handle errors reading the config file
-		log.WithFields(logrus.Fields{"error": err}).Fatal("Error while processing configuration")
-	}
-
-	log.Infof("Using config file: %s\n", viper.ConfigFileUsed())
-	err = viper.Unmarshal(&Config)
-	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Fatal("Error while unmarshalling")
-	}
-
-	// inject name from map names, apply defaults
-	for name, s := range Config.Satellites {
-		s.Name = name
-		Config.Satellites[name] = s
-	}
-	for name, k := range Config.Targets {
-		k.Name = name
-		if k.ProbeType == "" {
-			k.ProbeType = DefaultProbeType
-		}
-		if k.BatchSize == 0 {
-			k.BatchSize = DefaultBatchSize
-		}
-		if k.Interval == 0 {
-			k.Interval = DefaultInterval
-		}
-		if k.Probes == 0 {
-			k.Probes = DefaultProbes
-		}
-
-		Config.Targets[name] = k
-	}
-
-	// validate targets configured
-	for key := range Config.Satellites {
-		targets := Config.Satellites[key].Targets
-
-		for _, key2 := range targets {
-			target, ok := Config.Targets[key2]
-			if !ok {
-				log.WithFields(
-					logrus.Fields{"target": target}).Fatal("Target referenced is not defined. Configuration invalid.")
+	viper.SetConfigType(configType(*configPtr))
+	ConfigFile = *configPtr
+
+	log.Infof("Using config file: %s\n", ConfigFile)
+	if _, _, _, err := reloadConfig(); err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			for _, err := range errs {
+				log.WithFields(logrus.Fields{"setting": err.Path, "error": err.Err}).Error("Configuration invalid.")
 			}
 		}
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Error while processing configuration")
 	}
 
-	if Config.Authorization == "" {
+	if Config.Authorization == "" && len(Config.Tokens) == 0 {
 		log.Warn("Running without authorization")
 	}
 
-	// set Version of config file to NOW
-	now := time.Now()
-	Config.Version = now.Unix()
-
 	log.Debugf("%+v", Config.SafeForLogging())
 }
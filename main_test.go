@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log = logrus.New()
+	log.SetOutput(io.Discard)
+
+	// setting secrets seals signing keys with the head key
+	dir, err := os.MkdirTemp("", "nprobe-test")
+	if err != nil {
+		panic(err)
+	}
+	headKeyFile = filepath.Join(dir, "head.key")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
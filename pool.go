@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// poolReportInterval is how often delays caused by the probe budget are
+// logged at most.
+const poolReportInterval = time.Minute
+
+// satellitePool bounds the probes of the satellite, set up by --max-probes
+// and --max-pps.
+var satellitePool = newProbePool(0, 0)
+
+// probePool bounds the probes a satellite runs at once and the packets per
+// second they send. Waiting probes are served in the order they arrived, as
+// every target queues at most one probe the targets take turns.
+type probePool struct {
+	mutex   sync.Mutex
+	max     int
+	running int
+	waiting []chan struct{}
+
+	// pps is the packet budget, tokens the packets left of it
+	pps     float64
+	tokens  float64
+	updated time.Time
+
+	delayed  int
+	maxDelay time.Duration
+	reported time.Time
+}
+
+// newProbePool returns a pool running at most maxProbes probes at once,
+// sending at most pps packets per second. Zero means no limit.
+func newProbePool(maxProbes int, pps float64) *probePool {
+	return &probePool{max: maxProbes, pps: pps, tokens: pps}
+}
+
+// run runs probe, which sends packets packets, once a slot is free and the
+// packets fit into the budget. It returns how long the probe was delayed, or
+// an error if ctx is done before the probe could run.
+func (p *probePool) run(ctx context.Context, packets int, probe func()) (time.Duration, error) {
+	delay, err := p.acquire(ctx, packets)
+	if err != nil {
+		return delay, err
+	}
+	defer p.release()
+
+	probe()
+	return delay, nil
+}
+
+// acquire waits for a free slot and for the packets to fit into the budget.
+func (p *probePool) acquire(ctx context.Context, packets int) (time.Duration, error) {
+	start := time.Now()
+
+	p.mutex.Lock()
+	queued := p.max > 0 && p.running >= p.max
+	if queued {
+		ready := make(chan struct{})
+		p.waiting = append(p.waiting, ready)
+		p.mutex.Unlock()
+
+		// release hands its slot over
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			p.mutex.Lock()
+			if i := slices.Index(p.waiting, ready); i >= 0 {
+				p.waiting = slices.Delete(p.waiting, i, i+1)
+				p.mutex.Unlock()
+				return time.Since(start), ctx.Err()
+			}
+			// the slot was handed over meanwhile
+			p.mutex.Unlock()
+			p.release()
+			return time.Since(start), ctx.Err()
+		}
+		p.mutex.Lock()
+	} else {
+		p.running++
+	}
+	wait := p.reserve(packets, time.Now())
+	p.mutex.Unlock()
+
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		p.release()
+		return time.Since(start), ctx.Err()
+	}
+	delay := time.Since(start)
+	if queued || wait > 0 {
+		p.report(delay)
+	}
+	return delay, nil
+}
+
+// release frees the slot of a finished probe, or hands it to the next
+// waiting probe.
+func (p *probePool) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.waiting) > 0 {
+		close(p.waiting[0])
+		p.waiting = p.waiting[1:]
+		return
+	}
+	p.running--
+}
+
+// reserve takes packets from the budget and returns how long to wait until
+// they are available. The budget fills up to one second of packets, a
+// reservation exceeding it is paid back by the following ones. Callers hold
+// p.mutex.
+func (p *probePool) reserve(packets int, now time.Time) time.Duration {
+	if p.pps <= 0 {
+		return 0
+	}
+	if !p.updated.IsZero() {
+		p.tokens = math.Min(p.pps, p.tokens+now.Sub(p.updated).Seconds()*p.pps)
+	}
+	p.updated = now
+
+	p.tokens -= float64(packets)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.pps * float64(time.Second))
+}
+
+// report counts a probe delayed by the budget and logs the delays at most
+// every poolReportInterval.
+func (p *probePool) report(delay time.Duration) {
+	p.mutex.Lock()
+	p.delayed++
+	p.maxDelay = max(p.maxDelay, delay)
+	if time.Since(p.reported) < poolReportInterval {
+		p.mutex.Unlock()
+		return
+	}
+	fields := logrus.Fields{
+		"delayed":    p.delayed,
+		"max delay":  p.maxDelay,
+		"max probes": p.max,
+		"max pps":    p.pps,
+		"queued":     len(p.waiting),
+	}
+	p.delayed, p.maxDelay, p.reported = 0, 0, time.Now()
+	p.mutex.Unlock()
+
+	log.WithFields(fields).Warn("Probes delayed by the probe budget")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProbePool(t *testing.T) {
+	p := newProbePool(2, 0)
+
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.run(context.Background(), 1, func() {
+				mutex.Lock()
+				running++
+				peak = max(peak, running)
+				order = append(order, i)
+				mutex.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			})
+		}()
+		// queue the probes in order
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if peak != 2 {
+		t.Errorf("%d probes ran at once, want 2", peak)
+	}
+	for i, id := range order {
+		if id != i {
+			t.Errorf("probes ran in order %v, want in the order they were queued", order)
+			break
+		}
+	}
+	if p.running != 0 || len(p.waiting) != 0 {
+		t.Errorf("pool not empty after the probes: %d running, %d waiting", p.running, len(p.waiting))
+	}
+}
+
+func TestProbePoolBudget(t *testing.T) {
+	p := newProbePool(0, 10)
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		after   time.Duration
+		packets int
+		wait    time.Duration
+	}{
+		// the budget starts with one second of packets
+		{0, 5, 0},
+		{0, 5, 0},
+		{0, 5, 500 * time.Millisecond},
+		// 5 packets paid back after 500ms
+		{500 * time.Millisecond, 5, 500 * time.Millisecond},
+		// the budget fills up to one second of packets only
+		{time.Hour, 20, time.Second},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.after)
+		if wait := p.reserve(tt.packets, now); wait != tt.wait {
+			t.Errorf("reservation %d: wait = %v, want %v", i, wait, tt.wait)
+		}
+	}
+
+	if wait := newProbePool(0, 0).reserve(1000, now); wait != 0 {
+		t.Errorf("wait = %v without a budget, want 0", wait)
+	}
+}
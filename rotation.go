@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+type SatelliteRotateResponsePacket struct {
+	Name                  string `mapstructure:"satellite_name"`
+	Secret                string `mapstructure:"secret"`
+	PreviousSecretExpires int64  `mapstructure:"previous_secret_expires"`
+}
+
+type SatelliteSecretResponsePacket struct {
+	// SealedSecret is the new secret, encrypted with a key derived from the previous secret
+	SealedSecret          string `mapstructure:"sealed_secret"`
+	PreviousSecretExpires int64  `mapstructure:"previous_secret_expires"`
+}
+
+// RotateSatelliteSecret issues a new secret for a satellite. The old secret
+// stays valid for the grace period given by the "grace" query parameter
+// (e.g. "2h", defaults to DefaultSecretGracePeriod).
+func RotateSatelliteSecret(w http.ResponseWriter, r *http.Request) {
+	// RotateSatelliteSecret is behind authMiddleware
+	satelliteName := chi.URLParam(r, "name")
+
+	// Validate satellite name
+	if err := ValidateIdentifier(satelliteName, "satellite name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid satellite name", err)
+		return
+	}
+
+	grace := DefaultSecretGracePeriod
+	if g := r.URL.Query().Get("grace"); g != "" {
+		var err error
+		grace, err = time.ParseDuration(g)
+		if err != nil || grace <= 0 {
+			handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid grace period", err)
+			return
+		}
+	}
+
+	cMutex.Lock()
+	satellite, found := Config.Satellites[satelliteName]
+	if !found {
+		cMutex.Unlock()
+		handleError(w, http.StatusNotFound, r.RequestURI, "Satellite not found", nil)
+		return
+	}
+
+	if satellite.Discovery != "" {
+		cMutex.Unlock()
+		handleError(w, http.StatusConflict, r.RequestURI, "Satellite is discovered and read-only",
+			fmt.Errorf("satellite was read from discovery %s", satellite.Discovery))
+		return
+	}
+
+	previous := satellite
+	secret := RandomString(20)
+	if err := satellite.rotateSecret(secret, time.Now().Add(grace)); err != nil {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure rotating secret", err)
+		return
+	}
+
+	Config.Satellites[satelliteName] = satellite
+	if err := WriteConfig(); err != nil {
+		Config.Satellites[satelliteName] = previous
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Secret not rotated.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "satellite.rotate_secret", "satellites/"+satelliteName, previous.SafeForLogging(), satellite.SafeForLogging())
+
+	log.WithFields(logrus.Fields{
+		"satellite": satelliteName,
+		"grace":     grace,
+	}).Info("Satellite secret rotated")
+
+	err := json.NewEncoder(w).Encode(SatelliteRotateResponsePacket{
+		Name:                  satelliteName,
+		Secret:                secret,
+		PreviousSecretExpires: satellite.PreviousSecretExpires,
+	})
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// GetSatelliteSecret hands a rotated secret to a satellite that still
+// authenticates with its previous secret. The secret is sealed with a key
+// derived from the previous secret, so it never crosses the wire in clear.
+func GetSatelliteSecret(w http.ResponseWriter, r *http.Request) {
+	satelliteName := chi.URLParam(r, "name")
+
+	// Validate satellite name
+	if err := ValidateIdentifier(satelliteName, "satellite name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid satellite name", err)
+		return
+	}
+
+	cMutex.RLock()
+	satellite, found := Config.Satellites[satelliteName]
+	cMutex.RUnlock()
+
+	if !found {
+		handleError(w, http.StatusNotFound, r.RequestURI, "Requested item not found", nil)
+		return
+	}
+
+	credential, err := authenticateSatellite(r, satellite)
+	if err != nil {
+		log.WithFields(logrus.Fields{"satellite": satelliteName, "error": err}).Warn("Satellite authentication failed")
+		handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here", nil)
+		return
+	}
+	recordSecretUse(w, satelliteName, credential)
+
+	if credential != CredentialPreviousSecret || satellite.PendingSecret == "" {
+		handleError(w, http.StatusNotFound, r.RequestURI, "No secret rotation pending",
+			errors.New("secret is only handed out to satellites using their previous secret"))
+		return
+	}
+
+	// the pending secret is sealed with the head key at rest, for the
+	// satellite it is sealed with the signing key of its old secret
+	previousKey := deriveSigningKey(r.Header.Get(HeaderAuthorization))
+	if r.Header.Get(HeaderNprobeSignature) != "" {
+		previousKey, err = openHeadSecret(satellite.PreviousSigningKey)
+	}
+	var sealed string
+	if err == nil {
+		var secret string
+		if secret, err = openHeadSecret(satellite.PendingSecret); err == nil {
+			sealed, err = sealPendingSecret(previousKey, secret)
+		}
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure sealing secret", err)
+		return
+	}
+
+	log.WithFields(logrus.Fields{"satellite": satelliteName}).Info("Satellite fetched rotated secret")
+
+	err = json.NewEncoder(w).Encode(SatelliteSecretResponsePacket{
+		SealedSecret:          sealed,
+		PreviousSecretExpires: satellite.PreviousSecretExpires,
+	})
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// recordSecretUse remembers which credential a satellite authenticated with.
+// Once the satellite uses its current secret, the pending secret is dropped,
+// expired previous secrets are dropped as well. Satellites still using their
+// previous secret are told to fetch the new one. The changes are kept in
+// memory and persisted with the next config write.
+func recordSecretUse(w http.ResponseWriter, satelliteName string, credential string) {
+	cMutex.Lock()
+	defer cMutex.Unlock()
+
+	s, found := Config.Satellites[satelliteName]
+	if !found {
+		return
+	}
+
+	s.LastSecretUsed = credential
+
+	if credential == CredentialSecret {
+		s.PendingSecret = ""
+	}
+	if s.PreviousSecretExpires != 0 && time.Now().Unix() >= s.PreviousSecretExpires {
+		s.clearRotation()
+	}
+	if credential == CredentialPreviousSecret && s.PendingSecret != "" {
+		w.Header().Set(HeaderNprobeSecretRotation, "pending")
+	}
+
+	Config.Satellites[satelliteName] = s
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRotateSatelliteSecret(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:   filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{"sat1": satelliteWithSecret("old-secret", "")},
+	}
+	cMutex.Unlock()
+
+	rotate := func(query string) *httptest.ResponseRecorder {
+		r := withNameParam(httptest.NewRequest("POST", "/satellites/x/secret"+query, nil), "sat1")
+		w := httptest.NewRecorder()
+		RotateSatelliteSecret(w, r)
+		return w
+	}
+
+	if w := rotate("?grace=soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid grace period status = %d, want 400", w.Code)
+	}
+
+	w := rotate("?grace=1h")
+	if w.Code != 200 {
+		t.Fatalf("rotate status = %d: %s", w.Code, w.Body.String())
+	}
+	var rotated SatelliteRotateResponsePacket
+	if err := json.NewDecoder(w.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if expires := time.Until(time.Unix(rotated.PreviousSecretExpires, 0)); expires < 59*time.Minute || expires > time.Hour {
+		t.Errorf("previous secret expires in %v, want the grace period of 1h", expires)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/satellites/{name}/secret", GetSatelliteSecret)
+	head := httptest.NewServer(router)
+	t.Cleanup(head.Close)
+
+	fetch := func(secret string) *http.Response {
+		r, _ := http.NewRequest("GET", head.URL+"/satellites/sat1/secret", nil)
+		r.Header.Set(HeaderAuthorization, secret)
+		response, err := head.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	// the satellite still using its old secret is told to fetch the new one
+	if response := fetch("old-secret"); response.StatusCode != 200 ||
+		response.Header.Get(HeaderNprobeSecretRotation) != "pending" {
+		t.Errorf("old secret within grace: status = %d, rotation header = %q",
+			response.StatusCode, response.Header.Get(HeaderNprobeSecretRotation))
+	}
+
+	// the satellite opens the secret sealed with its old signing key
+	t.Run("fetch", func(t *testing.T) {
+		client := satelliteClient
+		secretFile = filepath.Join(t.TempDir(), "secret")
+		secretRotationUrl = head.URL + "/satellites/sat1/secret"
+		satelliteClient = head.Client()
+		t.Cleanup(func() {
+			secretFile, secretRotationUrl, signRequests, satelliteClient = "", "", false, client
+			satelliteSecret.Set("")
+		})
+
+		for _, signed := range []bool{false, true} {
+			satelliteSecret.Set("old-secret")
+			signRequests = signed
+
+			if err := fetchRotatedSecret(); err != nil {
+				t.Fatalf("fetchRotatedSecret(signed %v) failed: %v", signed, err)
+			}
+			if satelliteSecret.String() != rotated.Secret {
+				t.Errorf("satellite did not switch to the rotated secret (signed %v)", signed)
+			}
+			info, err := os.Stat(secretFile)
+			if err != nil || info.Mode().Perm() != 0600 {
+				t.Fatalf("secret file not written with mode 0600: %v", err)
+			}
+			data, _ := os.ReadFile(secretFile)
+			if strings.TrimSpace(string(data)) != rotated.Secret {
+				t.Errorf("secret file holds %q, want the rotated secret", data)
+			}
+		}
+	})
+
+	// using the new secret completes the rotation and clears the header
+	response := fetch(rotated.Secret)
+	if response.StatusCode != http.StatusNotFound || response.Header.Get(HeaderNprobeSecretRotation) != "" {
+		t.Errorf("new secret: status = %d, rotation header = %q, want 404 without header",
+			response.StatusCode, response.Header.Get(HeaderNprobeSecretRotation))
+	}
+	cMutex.RLock()
+	sat1 := Config.Satellites["sat1"]
+	cMutex.RUnlock()
+	if sat1.PendingSecret != "" || sat1.LastSecretUsed != CredentialSecret {
+		t.Errorf("pending secret = %q, last used = %q after the new secret was used", sat1.PendingSecret, sat1.LastSecretUsed)
+	}
+	if response := fetch("old-secret"); response.StatusCode != http.StatusNotFound ||
+		response.Header.Get(HeaderNprobeSecretRotation) != "" {
+		t.Errorf("old secret after fetch: status = %d, rotation header = %q, want 404 without header",
+			response.StatusCode, response.Header.Get(HeaderNprobeSecretRotation))
+	}
+
+	// the old secret is refused once the grace period ended
+	cMutex.Lock()
+	sat1 = Config.Satellites["sat1"]
+	sat1.PreviousSecretExpires = time.Now().Unix() - 1
+	Config.Satellites["sat1"] = sat1
+	cMutex.Unlock()
+	if response := fetch("old-secret"); response.StatusCode != http.StatusForbidden {
+		t.Errorf("old secret after grace: status = %d, want 403", response.StatusCode)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// rrdWriteBatch is the number of points written to the database at once.
+const rrdWriteBatch = 5000
+
+// rrdDump is the XML written by "rrdtool dump". Rows are not timestamped,
+// they end at the last update, aligned to the resolution of their archive.
+type rrdDump struct {
+	Step       int64 `xml:"step"`
+	LastUpdate int64 `xml:"lastupdate"`
+	DS         []struct {
+		Name string `xml:"name"`
+	} `xml:"ds"`
+	RRA []struct {
+		CF        string `xml:"cf"`
+		PDPPerRow int64  `xml:"pdp_per_row"`
+		Rows      []struct {
+			V []string `xml:"v"`
+		} `xml:"database>row"`
+	} `xml:"rra"`
+}
+
+// readRRD reads the samples of a smokeping RRD file, or of its "rrdtool dump"
+// XML. RRD files are dumped with rrdtool, which has to be installed.
+func readRRD(file string) ([]Probe, error) {
+	var data []byte
+	var err error
+	if filepath.Ext(file) == ".rrd" {
+		data, err = exec.Command("rrdtool", "dump", file).Output()
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dump rrdDump
+	if err := xml.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+	return rrdProbes(dump)
+}
+
+// rrdProbes converts the AVERAGE archives of a smokeping RRD into probes.
+// Finer archives take precedence, coarser ones only add older samples. The
+// ping data sources hold the sorted round trip times of the pings in seconds,
+// loss the number of lost pings.
+func rrdProbes(dump rrdDump) ([]Probe, error) {
+	median, loss := -1, -1
+	var pings []int
+	for i, ds := range dump.DS {
+		name := strings.TrimSpace(ds.Name)
+		switch {
+		case name == "median":
+			median = i
+		case name == "loss":
+			loss = i
+		case strings.HasPrefix(name, "ping"):
+			if _, err := strconv.Atoi(name[len("ping"):]); err == nil {
+				pings = append(pings, i)
+			}
+		}
+	}
+	if median < 0 || loss < 0 || len(pings) == 0 || dump.Step <= 0 {
+		return nil, errors.New("not a smokeping RRD, median, loss or ping data sources are missing")
+	}
+
+	rras := dump.RRA[:0:0]
+	for _, rra := range dump.RRA {
+		if strings.TrimSpace(rra.CF) == "AVERAGE" && rra.PDPPerRow > 0 {
+			rras = append(rras, rra)
+		}
+	}
+	sort.SliceStable(rras, func(i, j int) bool { return rras[i].PDPPerRow < rras[j].PDPPerRow })
+
+	value := func(values []string, i int) float64 {
+		if i >= len(values) {
+			return math.NaN()
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(values[i]), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return v
+	}
+
+	var probes []Probe
+	covered := int64(math.MaxInt64)
+	for _, rra := range rras {
+		resolution := dump.Step * rra.PDPPerRow
+		end := dump.LastUpdate - dump.LastUpdate%resolution
+		start := end - int64(len(rra.Rows)-1)*resolution
+
+		for i, row := range rra.Rows {
+			timestamp := start + int64(i)*resolution
+			if timestamp >= covered {
+				break
+			}
+			lost := value(row.V, loss)
+			if math.IsNaN(lost) {
+				continue
+			}
+
+			probe := Probe{
+				Loss:      lost / float64(len(pings)) * 100,
+				NumProbes: len(pings),
+				Timestamp: time.Unix(timestamp, 0),
+			}
+			if m := value(row.V, median); !math.IsNaN(m) {
+				probe.Median = m * 1000
+			}
+
+			var rtts []float64
+			for _, p := range pings {
+				if rtt := value(row.V, p); !math.IsNaN(rtt) {
+					rtts = append(rtts, rtt*1000)
+				}
+			}
+			if len(rtts) > 0 {
+				probe.MinRTT, probe.MaxRTT = rtts[0], rtts[0]
+				var sum float64
+				for _, rtt := range rtts {
+					probe.MinRTT = math.Min(probe.MinRTT, rtt)
+					probe.MaxRTT = math.Max(probe.MaxRTT, rtt)
+					sum += rtt
+				}
+				mean := sum / float64(len(rtts))
+				var variance float64
+				for _, rtt := range rtts {
+					variance += (rtt - mean) * (rtt - mean)
+				}
+				probe.StdDev = math.Sqrt(variance / float64(len(rtts)))
+			}
+			probes = append(probes, probe)
+		}
+		covered = min(covered, start)
+	}
+
+	sort.Slice(probes, func(i, j int) bool { return probes[i].Timestamp.Before(probes[j].Timestamp) })
+	return probes, nil
+}
+
+// rrdTarget maps the path of a smokeping RRD file below the data directory,
+// without extension, to its satellite and target. Smokeping stores the data
+// of target Local/Router as Local/Router.rrd for the master and as
+// Local/Router~slave.rrd for its slaves. Targets are found by their path
+// tag, so targets renamed on import because of a name collision are found.
+func rrdTarget(c *Configuration, path string, master string) (Satellite, Target, error) {
+	path, slave, _ := strings.Cut(path, "~")
+	satelliteName := master
+	if slave != "" {
+		satelliteName = smokepingName(slave)
+	}
+	targetName := smokepingName(strings.ReplaceAll(path, "/", "-"))
+	for name, t := range c.Targets {
+		if t.Tags["path"] == path {
+			targetName = name
+			break
+		}
+	}
+
+	if satelliteName == "" {
+		return Satellite{}, Target{}, errors.New("no satellite for the master data")
+	}
+	satellite, found := c.Satellites[satelliteName]
+	if !found {
+		return Satellite{}, Target{}, fmt.Errorf("satellite %s is not configured", satelliteName)
+	}
+	target, found := c.Targets[targetName]
+	if !found {
+		return Satellite{}, Target{}, fmt.Errorf("target %s is not configured", targetName)
+	}
+	return satellite, resolveTarget(c, satellite, target), nil
+}
+
+// importRRDCommand implements "nprobe import-rrd". It writes the samples of
+// the smokeping RRD files below a data directory to the database of a config
+// file, for the targets and satellites created by "nprobe import-smokeping".
+// It returns the exit code.
+func importRRDCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import-rrd", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dataDir := flags.String("data", "", "smokeping data directory with RRD files or their rrdtool dump XML")
+	configFile := flags.String("config", "config/config.json", "config file with the database, targets and satellites")
+	master := flags.String("master", "master", "satellite the data of the smokeping master is imported for, empty to skip it")
+	dryRun := flags.Bool("dry-run", false, "read the data without writing it")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dataDir == "" {
+		fmt.Fprintln(stderr, "-data is required")
+		return 2
+	}
+
+	var c Configuration
+	data, err := os.ReadFile(*configFile)
+	if err == nil {
+		c, _, err = readConfig(data, configType(*configFile), resolveReference)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+	if envToken := os.Getenv("INFLUXDB_TOKEN"); envToken != "" {
+		c.Database.Token = envToken
+	}
+
+	var writeAPI api.WriteAPIBlocking
+	if !*dryRun {
+		if c.Database.Host == "" {
+			fmt.Fprintf(stderr, "%s: no database configured\n", *configFile)
+			return 1
+		}
+		if err := ValidateInfluxToken(c.Database.Token); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *configFile, err)
+			return 1
+		}
+		client := influxdb2.NewClient(c.Database.Host, c.Database.Token)
+		defer client.Close()
+		writeAPI = client.WriteAPIBlocking(c.Database.Org, c.Database.Bucket)
+	}
+
+	failed := false
+	err = filepath.WalkDir(*dataDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(file)
+		if entry.IsDir() || (ext != ".rrd" && ext != ".xml") {
+			return nil
+		}
+		rel, err := filepath.Rel(*dataDir, file)
+		if err != nil {
+			return err
+		}
+
+		satellite, target, err := rrdTarget(&c, strings.TrimSuffix(filepath.ToSlash(rel), ext), *master)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: skipping, %v\n", file, err)
+			return nil
+		}
+		probes, err := readRRD(file)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", file, err)
+			failed = true
+			return nil
+		}
+
+		if writeAPI != nil {
+			points := probePoints(ResponsePacket{
+				SatelliteName: satellite.Name,
+				TargetName:    target.Name,
+				ProbeType:     target.ProbeType,
+				Probes:        probes,
+			})
+			for len(points) > 0 {
+				batch := points[:min(len(points), rrdWriteBatch)]
+				if err := writeAPI.WritePoint(context.Background(), batch...); err != nil {
+					return fmt.Errorf("writing %s: %w", file, err)
+				}
+				points = points[len(batch):]
+			}
+		}
+		fmt.Fprintf(stdout, "%s: %d samples of target %s on satellite %s\n", file, len(probes), target.Name, satellite.Name)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRRDDump is a smokeping RRD with 3 pings, a 60s archive of 3 rows and a
+// 120s archive of 3 rows, dumped at 1700000130.
+const testRRDDump = `<?xml version="1.0" encoding="utf-8"?>
+<rrd>
+	<version>0003</version>
+	<step>60</step>
+	<lastupdate>1700000130</lastupdate>
+	<ds><name> uptime </name><type> GAUGE </type></ds>
+	<ds><name> loss </name><type> GAUGE </type></ds>
+	<ds><name> median </name><type> GAUGE </type></ds>
+	<ds><name> ping1 </name><type> GAUGE </type></ds>
+	<ds><name> ping2 </name><type> GAUGE </type></ds>
+	<ds><name> ping3 </name><type> GAUGE </type></ds>
+	<rra>
+		<cf>MAX</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<cdp_prep><ds><value>NaN</value></ds></cdp_prep>
+		<database>
+			<row><v>1</v><v>3</v><v>1</v><v>1</v><v>1</v><v>1</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>2</pdp_per_row>
+		<database>
+			<!-- 1699999800 --> <row><v>1</v><v>0</v><v>2.0e-02</v><v>1.0e-02</v><v>2.0e-02</v><v>3.0e-02</v></row>
+			<!-- 1699999920 --> <row><v>1</v><v>0</v><v>5.0e-02</v><v>5.0e-02</v><v>5.0e-02</v><v>5.0e-02</v></row>
+			<!-- 1700000040 --> <row><v>1</v><v>0</v><v>5.0e-02</v><v>5.0e-02</v><v>5.0e-02</v><v>5.0e-02</v></row>
+		</database>
+	</rra>
+	<rra>
+		<cf>AVERAGE</cf>
+		<pdp_per_row>1</pdp_per_row>
+		<database>
+			<!-- 1699999980 --> <row><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v></row>
+			<!-- 1700000040 --> <row><v>1</v><v>1</v><v>1.5e-02</v><v>1.0e-02</v><v>2.0e-02</v><v>NaN</v></row>
+			<!-- 1700000100 --> <row><v>1</v><v>3</v><v>NaN</v><v>NaN</v><v>NaN</v><v>NaN</v></row>
+		</database>
+	</rra>
+</rrd>
+`
+
+func TestImportRRD(t *testing.T) {
+	var mutex sync.Mutex
+	var lines []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "nprobe" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	if err := os.MkdirAll(filepath.Join(dataDir, "Local"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Router.xml", "Router~boomer.xml", "Unknown.xml"} {
+		if err := os.WriteFile(filepath.Join(dataDir, "Local", name), []byte(testRRDDump), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := filepath.Join(dir, "config.json")
+	config := `{
+		"database": {"host": "` + influx.URL + `", "token": "0123456789abcdefghijklmnopqrstuvwxyz", "org": "nprobe", "bucket": "nprobe"},
+		"satellites": {"master": {"active": true}, "boomer": {"active": true}},
+		"targets": {"local-router": {"host": "192.168.1.1"}}
+	}`
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-data", dataDir, "-config", configFile}
+	if code := importRRDCommand(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("importRRDCommand() = %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "skipping, target local-unknown is not configured") {
+		t.Errorf("no warning about the unknown target: %s", stderr.String())
+	}
+
+	// the 60s archive covers 1699999980 to 1700000100, the 120s archive adds
+	// the two older rows
+	expected := []string{
+		`stat,unit=milliseconds,target=local-router\ (icmp),probe=master stddev=8.16496580927726,median=20,max=30,min=10,loss=0 1699999800000000000`,
+		`stat,unit=milliseconds,target=local-router\ (icmp),probe=master stddev=0,median=50,max=50,min=50,loss=0 1699999920000000000`,
+		`stat,unit=milliseconds,target=local-router\ (icmp),probe=master stddev=5,median=15,max=20,min=10,loss=33.33333333333333 1700000040000000000`,
+		`stat,unit=milliseconds,target=local-router\ (icmp),probe=master stddev=0,median=0,max=0,min=0,loss=100 1700000100000000000`,
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(lines) != 2*len(expected) {
+		t.Fatalf("written %d points, want %d: %s", len(lines), 2*len(expected), strings.Join(lines, "\n"))
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("point %d = %s, want %s", i, lines[i], line)
+		}
+		if slave := strings.Replace(line, "probe=master", "probe=boomer", 1); lines[len(expected)+i] != slave {
+			t.Errorf("point %d = %s, want %s", len(expected)+i, lines[len(expected)+i], slave)
+		}
+	}
+}
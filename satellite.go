@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/digitaljanitors/go-httpstat"
@@ -17,11 +21,27 @@ import (
 )
 
 const retryCounter = 10
-const retryTimer = 10 // seconds
 
-func (wk *Worker) HandleProbe(ch chan *Worker) (err error) {
+// retryTimer is the time between submission attempts.
+var retryTimer = 10 * time.Second
+
+var secretFile string
+var rotationMutex sync.Mutex
+
+// submissions tracks the running submissions, which a stopping satellite
+// waits for.
+var submissions sync.WaitGroup
+
+// stopSatellite stops the satellite with a cause, set up in main.
+var stopSatellite context.CancelCauseFunc = func(error) {}
+
+var errHeadConfigNewer = errors.New("head config is newer")
+
+// HandleProbe probes the target of the worker until ctx is done. Results
+// not submitted yet are spooled then.
+func (wk *Worker) HandleProbe(ctx context.Context, ch chan *Worker) (err error) {
 	defer func() {
-		log.WithFields(logrus.Fields{"worker": wk.Id, "target": wk.Target.Name}).Error("Running through defer")
+		log.WithFields(logrus.Fields{"worker": wk.Id, "target": wk.Target.Name}).Debug("Running through defer")
 		if r := recover(); r != nil {
 			if err, ok := r.(error); ok {
 				wk.Err = err
@@ -29,37 +49,106 @@ func (wk *Worker) HandleProbe(ch chan *Worker) (err error) {
 				wk.Err = fmt.Errorf("panic happened with %v", r)
 				log.WithFields(logrus.Fields{"worker": wk.Id, "target": wk.Target.Name, "error": wk.Err}).Error("Paniced")
 			}
-		} else {
+		} else if err != nil {
 			wk.Err = err
 			log.WithFields(logrus.Fields{"worker": wk.Id, "target": wk.Target.Name, "error": wk.Err}).Error("Error")
 		}
 		ch <- wk
 	}()
 
-	for {
+	probeFunc := map[string]func(context.Context) Probe{
+		"icmp": wk.Target.probeIcmp,
+		"http": wk.Target.probeHttp,
+	}[wk.Target.ProbeType]
+
+	s := newSchedule(wk.ProbeName, wk.Target)
+	url := wk.HeadUrl + "satellites/" + wk.ProbeName + "/" + wk.Target.Name + "/metrics"
+	probes := make([]Probe, 0, wk.Target.BatchSize)
+	packet := func() ResponsePacket {
+		return ResponsePacket{
+			SatelliteName: wk.ProbeName,
+			ProbeType:     wk.Target.ProbeType,
+			TargetName:    wk.Target.Name,
+			Probes:        probes,
+		}
+	}
+	// stop spools the probes of the unfinished batch
+	stop := func() error {
+		if len(probes) > 0 {
+			spoolProbes(packet())
+		}
+		return nil
+	}
+
+	for tick := s.next(time.Now()); ; {
 		log.WithFields(logrus.Fields{
 			"target":   wk.Target.Name,
 			"type":     wk.Target.ProbeType,
 			"interval": wk.Target.Interval,
-		}).Debug("Sleeping in main for loop")
-		time.Sleep(time.Duration(wk.Target.Interval) * time.Second)
-		log.Debug("Time to wake up")
-		var r = ResponsePacket{}
-
-		if wk.Target.ProbeType == "icmp" {
-			log.Debug("probe type: icmp")
-			r = wk.Target.probeIcmp(wk.ProbeName)
+			"tick":     tick,
+		}).Debug("Sleeping until next tick")
+		select {
+		case <-time.After(time.Until(tick)):
+		case <-ctx.Done():
+			return stop()
+		}
+		if probeFunc == nil {
+			return fmt.Errorf("unknown probe type %s", wk.Target.ProbeType)
 		}
-		if wk.Target.ProbeType == "http" {
-			r = wk.Target.probeHttp(wk.ProbeName)
+
+		// the lag includes the time waiting for the probe budget
+		var probe Probe
+		var lag float64
+		_, err := satellitePool.run(ctx, wk.Target.Probes, func() {
+			lag = float64(time.Since(tick)) / float64(time.Millisecond)
+			probe = probeFunc(ctx)
+			probe.Lag = &lag
+		})
+		if err != nil || ctx.Err() != nil {
+			// an interrupted probe is incomplete and dropped
+			return stop()
+		}
+
+		log.WithFields(logrus.Fields{
+			"target": wk.Target.Name,
+			"type":   wk.Target.ProbeType,
+			"min":    probe.MinRTT,
+			"max":    probe.MaxRTT,
+			"median": probe.Median,
+			"stdev":  probe.StdDev,
+			"loss":   probe.Loss,
+			"lag":    lag,
+		}).Debug()
+
+		probes = append(probes, probe)
+		if len(probes) >= wk.Target.BatchSize {
+			r := packet()
+			submissions.Add(1)
+			go func() {
+				defer submissions.Done()
+				submitProbes(ctx, r, url)
+			}()
+			probes = make([]Probe, 0, wk.Target.BatchSize)
 		}
 
-		go wk.Target.submitProbes(r, wk.HeadUrl+"satellites/"+wk.ProbeName+"/"+
-			wk.Target.Name+"/metrics")
+		// a probe running longer than the interval skips the ticks it missed
+		// instead of shifting all following ticks
+		next := s.next(tick)
+		if now := time.Now(); next.Before(now) {
+			log.WithFields(logrus.Fields{
+				"target":   wk.Target.Name,
+				"interval": wk.Target.Interval,
+				"skipped":  int(now.Sub(next)/s.interval) + 1,
+			}).Warn("Probe took longer than its interval, skipping ticks")
+			next = s.next(now)
+		}
+		tick = next
 	}
 }
 
-func (target *Target) submitProbes(r ResponsePacket, url string) {
+// submitProbes submits r to url, retrying if the head can't be reached. If
+// ctx is done while waiting for a retry or all retries failed, r is spooled.
+func submitProbes(ctx context.Context, r ResponsePacket, url string) {
 
 	retry := true
 	count := 0
@@ -71,193 +160,237 @@ func (target *Target) submitProbes(r ResponsePacket, url string) {
 	}
 
 	jsonValue, _ := json.Marshal(r)
-	request2, _ := http.NewRequest("PUT", url, bytes.NewBuffer(jsonValue))
-	request2.Header.Set(HeaderAuthorization, os.Getenv("NPROBE_SECRET"))
-	request2.Header.Set(HeaderNprobeVersion, version)
-	request2.Header.Set(HeaderNprobeConfig, fmt.Sprintf("%d", Config.Version))
-	request2.Header.Set(HeaderNprobePayloadHash, fmt.Sprintf("%d", payloadHash))
-	client2 := &http.Client{}
-
 	for retry {
-		body, err := client2.Do(request2)
+		// a fresh request per attempt, the body is consumed and signatures must not be replayed
+		request2, _ := http.NewRequest("PUT", url, bytes.NewBuffer(jsonValue))
+		request2.Header.Set(HeaderNprobeVersion, version)
+		request2.Header.Set(HeaderNprobeConfig, fmt.Sprintf("%d", Config.Version))
+		request2.Header.Set(HeaderNprobePayloadHash, fmt.Sprintf("%d", payloadHash))
+		if err := authorizeRequest(request2, jsonValue); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Error("Failed to sign request. Discarding submission.")
+			break
+		}
+
+		body, err := satelliteClient.Do(request2)
 		if err != nil {
 			log.WithFields(logrus.Fields{"error": err}).Error("HTTP request failed.")
-			log.Debug("Sleeping for 10 seconds")
-			time.Sleep(time.Duration(retryTimer * time.Second))
+			log.WithFields(logrus.Fields{"delay": retryTimer}).Debug("Sleeping before retry")
+			select {
+			case <-time.After(retryTimer):
+			case <-ctx.Done():
+				spoolProbes(r)
+				return
+			}
 			log.WithFields(logrus.Fields{"retry counter": count}).Info("Time to retry")
 			count++
 
 			if count == retryCounter {
-				log.Error("Retry counter reached. Discarding submission.")
+				log.Error("Retry counter reached. Spooling submission.")
+				spoolProbes(r)
 				break
 			}
 		} else {
 			retry = false
 			log.WithFields(logrus.Fields{"body": body}).Debug()
+			body.Body.Close()
+
+			checkSecretRotation(body)
 
-			// this is very ugly. Ideally we need to propagate the need to exit through all
-			// our go routines to exit gracefully
 			if body.StatusCode == 204 {
-				log.Info("Head Config newer than ours. Exiting.")
-				os.Exit(0)
+				log.Info("Head Config newer than ours. Stopping.")
+				stopSatellite(errHeadConfigNewer)
 			}
 		}
 	}
 }
 
-func (target *Target) probeIcmp(probeName string) ResponsePacket {
-
-	probes := make([]Probe, target.BatchSize)
-
-	for i := 0; i < target.BatchSize; i++ {
+// authorizeRequest adds the satellite credentials to req. With --sign-requests
+// the request is signed and the secret itself is not sent.
+func authorizeRequest(req *http.Request, body []byte) error {
+	secret := satelliteSecret.String()
+	if signRequests {
+		return SignRequest(req, deriveSigningKey(secret), body)
+	}
+	req.Header.Set(HeaderAuthorization, secret)
+	return nil
+}
 
-		if i != 0 {
+// probeIcmp pings the target Probes times and returns the statistics.
+func (target *Target) probeIcmp(ctx context.Context) Probe {
+	pinger, err := ping.NewPinger(target.Host)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Pinger error")
+	}
+	if Config.Debug {
+		pinger.Debug = true
+		pinger.OnRecv = func(pkt *ping.Packet) {
 			log.WithFields(logrus.Fields{
-				"target":   target.Name,
-				"type":     target.ProbeType,
-				"interval": target.Interval,
-			}).Debug("Sleeping in probe loop")
-			time.Sleep(time.Duration(target.Interval) * time.Second)
+				"bytes":    pkt.Nbytes,
+				"IP":       pkt.IPAddr,
+				"Sequence": pkt.Seq,
+				"Time":     pkt.Rtt,
+			}).Debug()
 		}
+	}
+	pinger.SetPrivileged(Config.Privileged)
+	pinger.SetLogger(log)
+	pinger.Timeout = time.Duration(5 * time.Second)
+
+	pinger.Count = target.Probes
+	err = pinger.Resolve()
+	if err != nil {
+		log.Fatalf("Failed to resolve: %s", err.Error())
+	}
+
+	err = pinger.RunWithContext(ctx) // blocks until finished
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Pinger error")
+	}
+
+	log.Debug("Pinger finished. Extracting stats...")
 
-		pinger, err := ping.NewPinger(target.Host)
+	stats := pinger.Statistics() // get send/receive/rtt stats
+
+	return Probe{
+		MinRTT:    float64(stats.MinRtt.Nanoseconds()) / 1000000,
+		MaxRTT:    float64(stats.MaxRtt.Nanoseconds()) / 1000000,
+		Median:    float64(stats.AvgRtt.Nanoseconds()) / 1000000,
+		StdDev:    float64(stats.StdDevRtt.Nanoseconds()) / 1000000,
+		Loss:      stats.PacketLoss,
+		NumProbes: target.Probes,
+		Timestamp: time.Now()}
+}
+
+// probeHttp requests the target Probes times and returns the statistics.
+func (target *Target) probeHttp(ctx context.Context) Probe {
+	min := math.MaxFloat64
+	max := 0.0
+
+	for j := 0; j < target.Probes; j++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", target.Host, nil)
 		if err != nil {
-			log.WithFields(logrus.Fields{"error": err}).Error("Pinger error")
-		}
-		if Config.Debug {
-			pinger.Debug = true
-			pinger.OnRecv = func(pkt *ping.Packet) {
-				log.WithFields(logrus.Fields{
-					"bytes":    pkt.Nbytes,
-					"IP":       pkt.IPAddr,
-					"Sequence": pkt.Seq,
-					"Time":     pkt.Rtt,
-				}).Debug()
-			}
+			log.WithFields(logrus.Fields{"error": err}).Error("http probe error")
 		}
-		pinger.SetPrivileged(Config.Privileged)
-		pinger.SetLogger(log)
-		pinger.Timeout = time.Duration(5 * time.Second)
-
-		pinger.Count = target.Probes
-		err = pinger.Resolve()
+		// Create a httpstat powered context
+		var result httpstat.Result
+		ctx := httpstat.WithHTTPStat(req.Context(), &result)
+		req = req.WithContext(ctx)
+		// Send request by default HTTP client
+		client := http.DefaultClient
+		res, err := client.Do(req)
 		if err != nil {
-			log.Fatalf("Failed to resolve: %s", err.Error())
+			log.WithFields(logrus.Fields{"error": err}).Error("http probe error")
+			break
 		}
+		if _, err := io.Copy(io.Discard, res.Body); err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Fatal()
+		}
+		result.End(time.Now())
+		err = res.Body.Close()
 
-		log.WithFields(logrus.Fields{
-			"batch": i,
-			"count": target.Probes,
-		}).Debug("starting next loop")
-
-		err = pinger.Run() // blocks until finished
 		if err != nil {
-			log.WithFields(logrus.Fields{"error": err}).Error("Pinger error")
+			log.WithFields(logrus.Fields{"error": err}).Error("Error closing http request")
 		}
 
-		log.Debug("Pinger finished. Extracting stats...")
+		con := float64(result.Total) / float64(time.Millisecond)
+		log.WithFields(logrus.Fields{"target": target.Name, "result": result}).Debug()
 
-		stats := pinger.Statistics() // get send/receive/rtt stats
+		if con < min {
+			min = con
+		}
+		if con > max {
+			max = con
+		}
+	}
 
-		probes[i] = Probe{
-			MinRTT:    float64(stats.MinRtt.Nanoseconds()) / 1000000,
-			MaxRTT:    float64(stats.MaxRtt.Nanoseconds()) / 1000000,
-			Median:    float64(stats.AvgRtt.Nanoseconds()) / 1000000,
-			StdDev:    float64(stats.StdDevRtt.Nanoseconds()) / 1000000,
-			Loss:      stats.PacketLoss,
-			NumProbes: target.Probes,
-			Timestamp: time.Now()}
+	return Probe{
+		MinRTT:    min,
+		MaxRTT:    max,
+		Median:    (min + max) / 2,
+		NumProbes: target.Probes,
+		Timestamp: time.Now()}
+}
 
-		log.WithFields(logrus.Fields{
-			"target": target.Name,
-			"type":   target.ProbeType,
-			"min":    probes[i].MinRTT,
-			"max":    probes[i].MaxRTT,
-			"median": probes[i].Median,
-			"stdev":  probes[i].StdDev,
-			"loss":   probes[i].Loss,
-		}).Debug()
+// loadSatelliteSecret reads the satellite secret from file, falling back to
+// the NPROBE_SECRET environment variable if the file is not set or missing.
+func loadSatelliteSecret(file string) error {
+	secretFile = file
+	secret := os.Getenv("NPROBE_SECRET")
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			secret = strings.TrimSpace(string(data))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 
-	response := ResponsePacket{
-		SatelliteName: probeName,
-		ProbeType:     target.ProbeType,
-		TargetName:    target.Name,
-		Probes:        probes,
+	if secret == "" {
+		log.Warn("No satellite secret configured")
 	}
 
-	return response
+	satelliteSecret.Set(secret)
+	return nil
 }
 
-func (target *Target) probeHttp(probeName string) ResponsePacket {
+// checkSecretRotation fetches the new secret if the head signals a pending
+// rotation in response. Only one fetch runs at a time.
+func checkSecretRotation(response *http.Response) {
+	if response.Header.Get(HeaderNprobeSecretRotation) == "" {
+		return
+	}
 
-	probes := make([]Probe, target.BatchSize)
+	if !rotationMutex.TryLock() {
+		return
+	}
+	defer rotationMutex.Unlock()
 
-	for i := 0; i < target.BatchSize; i++ {
+	if err := fetchRotatedSecret(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Failed to fetch rotated secret")
+	}
+}
 
-		min := math.MaxFloat64
-		max := 0.0
+func fetchRotatedSecret() error {
+	log.Info("Head rotated our secret, fetching the new one")
 
-		for j := 0; j < target.Probes; j++ {
-			req, err := http.NewRequest("GET", target.Host, nil)
-			if err != nil {
-				log.WithFields(logrus.Fields{"error": err}).Error("http probe error")
-			}
-			// Create a httpstat powered context
-			var result httpstat.Result
-			ctx := httpstat.WithHTTPStat(req.Context(), &result)
-			req = req.WithContext(ctx)
-			// Send request by default HTTP client
-			client := http.DefaultClient
-			res, err := client.Do(req)
-			if err != nil {
-				log.WithFields(logrus.Fields{"error": err}).Error("http probe error")
-				break
-			}
-			if _, err := io.Copy(io.Discard, res.Body); err != nil {
-				log.WithFields(logrus.Fields{"error": err}).Fatal()
-			}
-			result.End(time.Now())
-			err = res.Body.Close()
+	request, _ := http.NewRequest("GET", secretRotationUrl, nil)
+	if err := authorizeRequest(request, nil); err != nil {
+		return err
+	}
 
-			if err != nil {
-				log.WithFields(logrus.Fields{"error": err}).Error("Error closing http request")
-			}
+	response, err := satelliteClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
 
-			con := float64(result.Total) / float64(time.Millisecond)
-			log.WithFields(logrus.Fields{"target": target.Name, "result": result}).Debug()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("head responded with status %d", response.StatusCode)
+	}
 
-			if con < min {
-				min = con
-			}
-			if con > max {
-				max = con
-			}
-		}
+	var packet SatelliteSecretResponsePacket
+	if err := json.NewDecoder(response.Body).Decode(&packet); err != nil {
+		return err
+	}
 
-		probes[i] = Probe{
-			MinRTT:    min,
-			MaxRTT:    max,
-			Median:    (min + max) / 2,
-			NumProbes: target.Probes,
-			Timestamp: time.Now()}
+	secret, err := openPendingSecret(deriveSigningKey(satelliteSecret.String()), packet.SealedSecret)
+	if err != nil {
+		return err
+	}
 
-		if i != 0 {
-			log.WithFields(logrus.Fields{
-				"target":   target.Name,
-				"type":     target.ProbeType,
-				"interval": target.Interval,
-			}).Debug("Sleeping in probe loop")
-			time.Sleep(time.Duration(target.Interval) * time.Second)
+	if secretFile != "" {
+		if err := writeSecretFile(secretFile, secret); err != nil {
+			return err
 		}
 	}
 
-	response := ResponsePacket{
-		SatelliteName: probeName,
-		ProbeType:     target.ProbeType,
-		TargetName:    target.Name,
-		Probes:        probes,
-	}
+	satelliteSecret.Set(secret)
+
+	log.WithFields(logrus.Fields{
+		"previous_secret_expires": time.Unix(packet.PreviousSecretExpires, 0),
+		"secret_file":             secretFile,
+	}).Info("Switched to rotated secret")
 
-	return response
+	return nil
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// ProbeDefaults are probe settings for targets that don't set them.
+type ProbeDefaults struct {
+	ProbeType string `mapstructure:"probe_type,omitempty"`
+	Probes    int    `mapstructure:"probes,omitempty"`
+	Interval  int    `mapstructure:"interval,omitempty"`
+	BatchSize int    `mapstructure:"batch_size,omitempty"`
+}
+
+// builtinProbeDefaults apply if neither the target nor a group sets a value.
+var builtinProbeDefaults = ProbeDefaults{
+	ProbeType: DefaultProbeType,
+	Probes:    DefaultProbes,
+	Interval:  DefaultInterval,
+	BatchSize: DefaultBatchSize,
+}
+
+// applyTo fills the settings target leaves unset.
+func (d ProbeDefaults) applyTo(target *Target) {
+	if target.ProbeType == "" {
+		target.ProbeType = d.ProbeType
+	}
+	if target.Probes == 0 {
+		target.Probes = d.Probes
+	}
+	if target.Interval == 0 {
+		target.Interval = d.Interval
+	}
+	if target.BatchSize == 0 {
+		target.BatchSize = d.BatchSize
+	}
+}
+
+// SatelliteGroup holds settings shared by satellites, e.g. of one region.
+// Satellites join groups by listing them in Satellite.Groups.
+type SatelliteGroup struct {
+	Name string `mapstructure:"name"`
+	// Active pauses all members if false, groups are active if it is not set
+	Active          *bool         `mapstructure:"active,omitempty"`
+	Targets         []string      `mapstructure:"targets,omitempty"`
+	TargetGroups    []string      `mapstructure:"target_groups,omitempty"`
+	TargetSelectors []string      `mapstructure:"target_selectors,omitempty"`
+	Defaults        ProbeDefaults `mapstructure:"defaults,omitempty"`
+}
+
+// SatelliteGroupPacket is a satellite group with its members.
+type SatelliteGroupPacket struct {
+	SatelliteGroup `mapstructure:",squash"`
+	Satellites     []string `mapstructure:"satellites"`
+}
+
+// IsActive reports whether the members of the group are probing.
+func (g SatelliteGroup) IsActive() bool {
+	return g.Active == nil || *g.Active
+}
+
+// satelliteActive reports whether a satellite and all its groups are active.
+// Callers hold cMutex.
+func satelliteActive(c *Configuration, satellite Satellite) bool {
+	if !satellite.Active {
+		return false
+	}
+	for _, name := range satellite.Groups {
+		if g, found := c.SatelliteGroups[name]; found && !g.IsActive() {
+			return false
+		}
+	}
+	return true
+}
+
+// satelliteGroupPacket returns a group with its members. Callers hold cMutex.
+func satelliteGroupPacket(c *Configuration, group SatelliteGroup) SatelliteGroupPacket {
+	packet := SatelliteGroupPacket{SatelliteGroup: group, Satellites: []string{}}
+	for name, s := range c.Satellites {
+		if slices.Contains(s.Groups, group.Name) {
+			packet.Satellites = append(packet.Satellites, name)
+		}
+	}
+	sort.Strings(packet.Satellites)
+	return packet
+}
+
+func ListSatelliteGroups(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	groups := make([]SatelliteGroupPacket, 0, len(Config.SatelliteGroups))
+	for _, g := range Config.SatelliteGroups {
+		groups = append(groups, satelliteGroupPacket(&Config, g))
+	}
+	cMutex.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	err := json.NewEncoder(w).Encode(groups)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func GetSatelliteGroup(w http.ResponseWriter, r *http.Request) {
+	groupName := chi.URLParam(r, "name")
+
+	// Validate group name
+	if err := ValidateIdentifier(groupName, "group name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid group name", err)
+		return
+	}
+
+	cMutex.RLock()
+	group, found := Config.SatelliteGroups[groupName]
+	packet := satelliteGroupPacket(&Config, group)
+	cMutex.RUnlock()
+
+	if !found {
+		handleError(w, http.StatusNotFound, r.RequestURI, "Requested item not found", nil)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(packet)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// PutSatelliteGroup creates or replaces a satellite group (PUT) or changes an
+// existing one (PATCH). PATCH only changes the settings given in the request,
+// so PATCH {"Active": false} pauses all members of a group.
+func PutSatelliteGroup(w http.ResponseWriter, r *http.Request) {
+	// PutSatelliteGroup is behind authMiddleware
+	groupName := chi.URLParam(r, "name")
+
+	// Validate group name
+	if err := ValidateIdentifier(groupName, "group name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid group name", err)
+		return
+	}
+
+	var request SatelliteGroup
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure parsing request. Group not changed.", err)
+		return
+	}
+
+	cMutex.Lock()
+	previous, existed := Config.SatelliteGroups[groupName]
+	if !existed && r.Method == http.MethodPatch {
+		cMutex.Unlock()
+		handleError(w, http.StatusNotFound, r.RequestURI, "Group not found", nil)
+		return
+	}
+
+	group := request
+	if r.Method == http.MethodPatch {
+		group = previous
+		if request.Active != nil {
+			group.Active = request.Active
+		}
+		if request.Targets != nil {
+			group.Targets = request.Targets
+		}
+		if request.TargetGroups != nil {
+			group.TargetGroups = request.TargetGroups
+		}
+		if request.TargetSelectors != nil {
+			group.TargetSelectors = request.TargetSelectors
+		}
+		if request.Defaults != (ProbeDefaults{}) {
+			group.Defaults = request.Defaults
+		}
+	}
+	group.Name = groupName
+
+	if errs := validateSatelliteGroup(&Config, group); len(errs) > 0 {
+		cMutex.Unlock()
+		handleConfigErrors(w, r.RequestURI, errs)
+		return
+	}
+
+	if Config.SatelliteGroups == nil {
+		Config.SatelliteGroups = make(map[string]SatelliteGroup)
+	}
+	Config.SatelliteGroups[groupName] = group
+
+	if err := WriteConfig(); err != nil {
+		if existed {
+			Config.SatelliteGroups[groupName] = previous
+		} else {
+			delete(Config.SatelliteGroups, groupName)
+		}
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Group not changed.", nil)
+		return
+	}
+	packet := satelliteGroupPacket(&Config, group)
+	cMutex.Unlock()
+
+	var before interface{}
+	if existed {
+		before = previous
+	}
+	recordAudit(r, auditActor(r), "satellite_group.put", "satellite-groups/"+groupName, before, group)
+
+	err := json.NewEncoder(w).Encode(packet)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+// DeleteSatelliteGroup removes a group without members.
+func DeleteSatelliteGroup(w http.ResponseWriter, r *http.Request) {
+	// DeleteSatelliteGroup is behind authMiddleware
+	groupName := chi.URLParam(r, "name")
+
+	// Validate group name
+	if err := ValidateIdentifier(groupName, "group name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid group name", err)
+		return
+	}
+
+	cMutex.Lock()
+	group, found := Config.SatelliteGroups[groupName]
+	if !found {
+		cMutex.Unlock()
+		handleError(w, http.StatusNotFound, r.RequestURI, "Group not found", nil)
+		return
+	}
+
+	if members := satelliteGroupPacket(&Config, group).Satellites; len(members) > 0 {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Group still has members", nil)
+		return
+	}
+
+	delete(Config.SatelliteGroups, groupName)
+	if err := WriteConfig(); err != nil {
+		Config.SatelliteGroups[groupName] = group
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Group not removed.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "satellite_group.delete", "satellite-groups/"+groupName, group, nil)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestResolveTargetsWithSatelliteGroups(t *testing.T) {
+	c := &Configuration{
+		SatelliteGroups: map[string]SatelliteGroup{
+			"eu":   {Name: "eu", Targets: []string{"dns1"}, Defaults: ProbeDefaults{Interval: 60, Probes: 10}},
+			"fast": {Name: "fast", TargetGroups: []string{"web"}, Defaults: ProbeDefaults{Interval: 10, ProbeType: "http"}},
+		},
+		Targets: map[string]Target{
+			"web1": {Name: "web1", Groups: []string{"web"}},
+			"dns1": {Name: "dns1", Interval: 5},
+		},
+	}
+
+	targets := resolveTargets(c, Satellite{Name: "sat1", Groups: []string{"eu", "fast"}})
+
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	if strings.Join(names, ",") != "dns1,web1" {
+		t.Fatalf("resolveTargets() = %v, want [dns1 web1]", names)
+	}
+
+	tests := []struct {
+		name     string
+		target   Target
+		expected Target
+	}{
+		{"target setting wins", targets[0], Target{Name: "dns1", Interval: 5, Probes: 10, ProbeType: "http", BatchSize: DefaultBatchSize}},
+		{"first group wins", targets[1], Target{Name: "web1", Groups: []string{"web"}, Interval: 60, Probes: 10, ProbeType: "http", BatchSize: DefaultBatchSize}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, want := tt.target, tt.expected
+			if got.Interval != want.Interval || got.Probes != want.Probes || got.ProbeType != want.ProbeType || got.BatchSize != want.BatchSize {
+				t.Errorf("resolved %s = %+v, want %+v", tt.target.Name, got, want)
+			}
+		})
+	}
+}
+
+func TestPauseSatelliteGroup(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog:        filepath.Join(dir, "audit.log"),
+		SatelliteGroups: map[string]SatelliteGroup{"eu": {Name: "eu"}},
+		Satellites: map[string]Satellite{
+			"sat1": {Name: "sat1", Active: true, Groups: []string{"eu"}},
+			"sat2": {Name: "sat2", Active: true},
+		},
+	}
+	cMutex.Unlock()
+
+	request := func(method string, body string) int {
+		r := httptest.NewRequest(method, "/satellite-groups/eu", strings.NewReader(body))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", "eu")
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+		w := httptest.NewRecorder()
+		switch method {
+		case "DELETE":
+			DeleteSatelliteGroup(w, r)
+		default:
+			PutSatelliteGroup(w, r)
+		}
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		active map[string]bool
+	}{
+		{"pause", "PATCH", `{"Active": false}`, 200, map[string]bool{"sat1": false, "sat2": true}},
+		{"change targets keeps pause", "PATCH", `{"TargetSelectors": ["env=prod"]}`, 200, map[string]bool{"sat1": false, "sat2": true}},
+		{"resume", "PATCH", `{"Active": true}`, 200, map[string]bool{"sat1": true, "sat2": true}},
+		{"replace", "PUT", `{"TargetSelectors": ["env=prod"]}`, 200, map[string]bool{"sat1": true, "sat2": true}},
+		{"invalid selector", "PATCH", `{"TargetSelectors": ["=prod"]}`, 422, map[string]bool{"sat1": true, "sat2": true}},
+		{"delete with members", "DELETE", ``, 400, map[string]bool{"sat1": true, "sat2": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := request(tt.method, tt.body); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			cMutex.RLock()
+			defer cMutex.RUnlock()
+			for name, want := range tt.active {
+				if got := satelliteActive(&Config, Config.Satellites[name]); got != want {
+					t.Errorf("satelliteActive(%s) = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+
+	cMutex.RLock()
+	defer cMutex.RUnlock()
+	if selectors := Config.SatelliteGroups["eu"].TargetSelectors; strings.Join(selectors, ",") != "env=prod" {
+		t.Errorf("TargetSelectors = %v, want [env=prod]", selectors)
+	}
+	// PUT replaced the group, the pause set by PATCH is gone
+	if Config.SatelliteGroups["eu"].Active != nil {
+		t.Errorf("Active = %v after PUT without it, want unset", *Config.SatelliteGroups["eu"].Active)
+	}
+}
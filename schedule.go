@@ -0,0 +1,40 @@
+package main
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// schedule fires at wall clock ticks every interval of a target. The ticks
+// are aligned to the Unix epoch and shifted by a jitter derived from the
+// satellite and target name, so targets with the same interval are spread
+// over the interval and a restarted satellite keeps its ticks.
+type schedule struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+// newSchedule returns the schedule of target on satellite.
+func newSchedule(satellite string, target Target) schedule {
+	interval := time.Duration(target.Interval) * time.Second
+	if interval <= 0 {
+		interval = DefaultInterval * time.Second
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(satellite + "/" + target.Name))
+	return schedule{
+		interval: interval,
+		offset:   time.Duration(h.Sum64() % uint64(interval)),
+	}
+}
+
+// next returns the first tick after t.
+func (s schedule) next(t time.Time) time.Time {
+	n := t.UnixNano() - int64(s.offset)
+	k := n / int64(s.interval)
+	if n < 0 {
+		k--
+	}
+	return time.Unix(0, (k+1)*int64(s.interval)+int64(s.offset))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	target := Target{Name: "router", Interval: 30}
+	s := newSchedule("sat1", target)
+
+	if s != newSchedule("sat1", target) {
+		t.Errorf("schedule is not deterministic")
+	}
+	if s.offset < 0 || s.offset >= 30*time.Second {
+		t.Errorf("offset = %v, want within the interval", s.offset)
+	}
+
+	now := time.Unix(1700000000, 123)
+	tick := s.next(now)
+	if !tick.After(now) || tick.Sub(now) > s.interval {
+		t.Errorf("next(%v) = %v, want within one interval", now, tick)
+	}
+	if offset := time.Duration(tick.UnixNano() % int64(s.interval)); offset != s.offset {
+		t.Errorf("tick offset = %v, want %v", offset, s.offset)
+	}
+	// ticks don't drift, the next tick after a tick is one interval later
+	for i := 0; i < 3; i++ {
+		if next := s.next(tick); next.Sub(tick) != s.interval {
+			t.Errorf("next(%v) = %v, want %v later", tick, next, s.interval)
+		}
+		tick = s.next(tick)
+	}
+
+	// targets with the same interval are spread over it
+	offsets := map[time.Duration]bool{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		offsets[newSchedule("sat1", Target{Name: name, Interval: 30}).offset] = true
+	}
+	if len(offsets) < 2 {
+		t.Errorf("targets got the same offset")
+	}
+
+	if s := newSchedule("sat1", Target{Name: "router"}); s.interval != DefaultInterval*time.Second {
+		t.Errorf("interval = %v, want default", s.interval)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// identifierPattern matches the names accepted by ValidateIdentifier.
+const identifierPattern = `^[a-zA-Z0-9]([a-zA-Z0-9._-]*[a-zA-Z0-9])?$`
+
+// schemaConstraints adds constraints the Go types can't express, keyed by
+// struct type and mapstructure name.
+var schemaConstraints = map[reflect.Type]map[string]map[string]interface{}{
+	reflect.TypeOf(Satellite{}): {
+		"certificate_auth": {"enum": []string{"", CertificateAuthSufficient, CertificateAuthRequired}},
+	},
+	// unset (0 or "") probe settings are taken from the defaults
+	reflect.TypeOf(Target{}): {
+		"probe_type": {"enum": append([]string{""}, validProbeTypes...)},
+		"probes":     {"minimum": 0},
+		"interval":   {"minimum": 0},
+		"batch_size": {"minimum": 0},
+	},
+	reflect.TypeOf(ProbeDefaults{}): {
+		"probe_type": {"enum": append([]string{""}, validProbeTypes...)},
+		"probes":     {"minimum": 0},
+		"interval":   {"minimum": 0},
+		"batch_size": {"minimum": 0},
+	},
+	reflect.TypeOf(TargetOverride{}): {
+		"probes":     {"minimum": 0},
+		"interval":   {"minimum": 0},
+		"batch_size": {"minimum": 0},
+	},
+	reflect.TypeOf(DiscoveryConfig{}): {
+		"type":             {"enum": slices.Sorted(maps.Keys(discoveryTypes))},
+		"probe_type":       {"enum": append([]string{""}, validProbeTypes...)},
+		"refresh_interval": {"minimum": 0},
+	},
+	reflect.TypeOf(APIToken{}): {
+		"scopes": {"items": map[string]interface{}{"enum": validScopes}, "minItems": 1},
+	},
+}
+
+// configSchema returns the JSON Schema of the configuration file.
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Configuration{}))
+	schema["$schema"] = schemaDraft
+	schema["title"] = "nprobe configuration"
+	// allows config files to point editors to the schema
+	schema["properties"].(map[string]interface{})["$schema"] = map[string]interface{}{"type": "string"}
+	return schema
+}
+
+// typeSchema builds the schema of t from the mapstructure tags of its fields.
+// Keys starting with an underscore are allowed everywhere, they are used for
+// comments.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"propertyNames":        map[string]interface{}{"pattern": identifierPattern},
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			property := typeSchema(field.Type)
+			for k, v := range schemaConstraints[t][name] {
+				property[k] = v
+			}
+			properties[name] = property
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"patternProperties":    map[string]interface{}{"^_": map[string]interface{}{}},
+			"additionalProperties": false,
+		}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// unknownKeys returns the paths of keys in a raw configuration value the
+// schema does not know, e.g. misspelled settings viper silently ignores.
+func unknownKeys(path string, value interface{}, schema map[string]interface{}) []string {
+	var unknown []string
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for key, child := range v {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if childSchema, found := properties[key].(map[string]interface{}); found {
+				unknown = append(unknown, unknownKeys(childPath, child, childSchema)...)
+			} else if additional != nil {
+				unknown = append(unknown, unknownKeys(childPath, child, additional)...)
+			} else if !strings.HasPrefix(key, "_") {
+				unknown = append(unknown, childPath)
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range v {
+			unknown = append(unknown, unknownKeys(fmt.Sprintf("%s.%d", path, i), item, items)...)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
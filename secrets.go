@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters for stored secrets (RFC 9106, OWASP minimum profile)
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+const argon2Prefix = "$argon2id$"
+
+// failedSecretTTL is how long a secret that didn't match a hash is
+// remembered, maxFailedSecrets how many of them at most.
+const (
+	failedSecretTTL  = time.Minute
+	maxFailedSecrets = 1024
+)
+
+// HashSecret returns a salted argon2id hash of secret in PHC string format.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifiedSecrets caches the digest of the last secret that matched a hash, so
+// satellites submitting every few seconds don't pay for argon2 on every
+// request. Digests of secrets that didn't match are kept until they expire, so
+// repeated failures don't either.
+var verifiedSecrets = struct {
+	sync.Mutex
+	m      map[string][sha256.Size]byte
+	failed map[[sha256.Size]byte]time.Time
+}{m: make(map[string][sha256.Size]byte), failed: make(map[[sha256.Size]byte]time.Time)}
+
+// argon2Slots bounds the argon2 computations running at once, each of them
+// takes argon2Memory KiB.
+var argon2Slots = make(chan struct{}, runtime.NumCPU())
+
+// VerifySecret reports whether secret matches a hash created by HashSecret.
+func VerifySecret(secret string, encoded string) bool {
+	if secret == "" || encoded == "" {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(encoded + "\x00" + secret))
+
+	verifiedSecrets.Lock()
+	cached, found := verifiedSecrets.m[encoded]
+	failedUntil := verifiedSecrets.failed[digest]
+	verifiedSecrets.Unlock()
+	if found && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+	if time.Now().Before(failedUntil) {
+		return false
+	}
+
+	if !verifyArgon2(secret, encoded) {
+		verifiedSecrets.Lock()
+		if len(verifiedSecrets.failed) >= maxFailedSecrets {
+			now := time.Now()
+			for d, until := range verifiedSecrets.failed {
+				if now.After(until) {
+					delete(verifiedSecrets.failed, d)
+				}
+			}
+			// still full of recent failures, start over
+			if len(verifiedSecrets.failed) >= maxFailedSecrets {
+				clear(verifiedSecrets.failed)
+			}
+		}
+		verifiedSecrets.failed[digest] = time.Now().Add(failedSecretTTL)
+		verifiedSecrets.Unlock()
+		return false
+	}
+
+	verifiedSecrets.Lock()
+	verifiedSecrets.m[encoded] = digest
+	verifiedSecrets.Unlock()
+
+	return true
+}
+
+// verifyArgon2 computes the argon2id hash of secret with the parameters and
+// salt of encoded and compares it, waiting for a free slot in argon2Slots.
+func verifyArgon2(secret string, encoded string) bool {
+	var version, memory, iterations int
+	var threads uint8
+	parts := strings.Split(strings.TrimPrefix(encoded, argon2Prefix), "$")
+	if !strings.HasPrefix(encoded, argon2Prefix) || len(parts) != 4 {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	argon2Slots <- struct{}{}
+	computed := argon2.IDKey([]byte(secret), salt, uint32(iterations), uint32(memory), threads, uint32(len(key)))
+	<-argon2Slots
+
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// setSecret stores the hash of secret on the satellite and the signing key
+// derived from it. The plaintext is not kept and any rotation in progress is
+// cancelled.
+func (s *Satellite) setSecret(secret string) error {
+	if secret == "" {
+		return errors.New("secret cannot be empty")
+	}
+
+	hash, err := HashSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	signingKey, err := sealHeadSecret(deriveSigningKey(secret))
+	if err != nil {
+		return err
+	}
+
+	s.Secret = ""
+	s.SecretHash = hash
+	s.SigningKey = signingKey
+	s.clearRotation()
+
+	return nil
+}
+
+// rotateSecret makes secret the current secret of the satellite while the old
+// one stays valid until validUntil. The new secret is kept sealed with the
+// head key until the satellite fetched it, see GetSatelliteSecret.
+func (s *Satellite) rotateSecret(secret string, validUntil time.Time) error {
+	if s.SecretHash == "" {
+		return errors.New("satellite has no secret to rotate")
+	}
+
+	previousHash, previousKey := s.SecretHash, s.SigningKey
+
+	sealed, err := sealHeadSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	if err := s.setSecret(secret); err != nil {
+		return err
+	}
+
+	s.PreviousSecretHash = previousHash
+	s.PreviousSigningKey = previousKey
+	s.PreviousSecretExpires = validUntil.Unix()
+	s.PendingSecret = sealed
+
+	return nil
+}
+
+// clearRotation drops the previous secret and the pending secret.
+func (s *Satellite) clearRotation() {
+	s.PreviousSecretHash = ""
+	s.PreviousSigningKey = ""
+	s.PreviousSecretExpires = 0
+	s.PendingSecret = ""
+}
+
+// migrateSatelliteSecrets replaces plaintext satellite secrets in c with their
+// hashes and signing keys. It reports whether anything was migrated, so the
+// caller can persist the result. Secrets read from a reference in references
+// are hashed as well but kept, so that the reference is written back instead
+// of the hash.
+func migrateSatelliteSecrets(c *Configuration, references map[string]configReference) (bool, error) {
+	migrated := false
+
+	for name, s := range c.Satellites {
+		if s.Secret == "" {
+			continue
+		}
+		secret := s.Secret
+		if err := s.setSecret(secret); err != nil {
+			return migrated, fmt.Errorf("satellite %s: %w", name, err)
+		}
+		if _, found := references["satellites."+strings.ToLower(name)+".secret"]; found {
+			s.Secret = secret
+		} else {
+			migrated = true
+		}
+		c.Satellites[name] = s
+	}
+
+	return migrated, nil
+}
+
+// headKeyFile holds the key the head seals signing keys and pending secrets
+// with, set by --head-key-file. By default head.key next to the config file.
+var headKeyFile string
+
+// headKey caches the key read from headKeyFile.
+var headKey = struct {
+	sync.Mutex
+	file string
+	key  []byte
+}{}
+
+// loadHeadKey returns the head key, creating the key file on first use. Key
+// files accessible by group or others are refused.
+func loadHeadKey() ([]byte, error) {
+	file := headKeyFile
+	if file == "" {
+		file = filepath.Join(filepath.Dir(ConfigFile), "head.key")
+	}
+
+	headKey.Lock()
+	defer headKey.Unlock()
+
+	if headKey.key != nil && headKey.file == file {
+		return headKey.key, nil
+	}
+
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("file", file).Info("Created head key")
+
+		headKey.file, headKey.key = file, key
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("head key %s must not be accessible by group or others", file)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("head key %s is not a base64 encoded 32 byte key", file)
+	}
+
+	headKey.file, headKey.key = file, key
+	return key, nil
+}
+
+// sealHeadSecret encrypts value with the head key, for values stored in the
+// config that only the head may read.
+func sealHeadSecret(value string) (string, error) {
+	key, err := loadHeadKey()
+	if err != nil {
+		return "", err
+	}
+	return sealSecret(key, value)
+}
+
+// openHeadSecret reverses sealHeadSecret.
+func openHeadSecret(sealed string) (string, error) {
+	key, err := loadHeadKey()
+	if err != nil {
+		return "", err
+	}
+	return openSecret(key, sealed)
+}
+
+// pendingSecretKey derives the key that protects a rotated secret on its way
+// to the satellite. It is derived from the previous signing key, which both
+// the head and the satellite still holding the old secret know.
+func pendingSecretKey(signingKey string) []byte {
+	key := sha256.Sum256([]byte(signingKey + "\x00nprobe-secret-rotation"))
+	return key[:]
+}
+
+// sealPendingSecret encrypts secret under a key derived from signingKey.
+func sealPendingSecret(signingKey string, secret string) (string, error) {
+	return sealSecret(pendingSecretKey(signingKey), secret)
+}
+
+// openPendingSecret reverses sealPendingSecret.
+func openPendingSecret(signingKey string, sealed string) (string, error) {
+	return openSecret(pendingSecretKey(signingKey), sealed)
+}
+
+// sealSecret encrypts secret with AES-GCM under key.
+func sealSecret(key []byte, secret string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// openSecret reverses sealSecret.
+func openSecret(key []byte, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed secret too short")
+	}
+
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashSecret(t *testing.T) {
+	hash, err := HashSecret("secret123")
+	if err != nil {
+		t.Fatalf("HashSecret failed: %v", err)
+	}
+
+	if strings.Contains(hash, "secret123") {
+		t.Errorf("hash contains the plaintext secret: %s", hash)
+	}
+
+	other, _ := HashSecret("secret123")
+	if hash == other {
+		t.Errorf("hashes of the same secret are identical, salt missing")
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		hash     string
+		expected bool
+	}{
+		{"matching secret", "secret123", hash, true},
+		{"matching secret again", "secret123", hash, true},
+		{"second hash", "secret123", other, true},
+		{"wrong secret", "secret456", hash, false},
+		{"empty secret", "", hash, false},
+		{"empty hash", "secret123", "", false},
+		{"plaintext instead of hash", "secret123", "secret123", false},
+		{"truncated hash", "secret123", hash[:len(hash)-10], false},
+		{"wrong algorithm", "secret123", strings.Replace(hash, "argon2id", "argon2i", 1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := VerifySecret(tt.secret, tt.hash); result != tt.expected {
+				t.Errorf("VerifySecret(%q, %q) = %v, want %v", tt.secret, tt.hash, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVerifySecretCachesFailures(t *testing.T) {
+	hash, err := HashSecret("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifySecret("wrong", hash) {
+		t.Fatalf("wrong secret verified")
+	}
+	digest := sha256.Sum256([]byte(hash + "\x00wrong"))
+	verifiedSecrets.Lock()
+	_, cached := verifiedSecrets.failed[digest]
+	verifiedSecrets.Unlock()
+	if !cached {
+		t.Errorf("failed verification not cached")
+	}
+
+	// a cached failure of another secret doesn't affect the right one
+	if !VerifySecret("secret123", hash) {
+		t.Errorf("secret not verified after a failure")
+	}
+
+	// expired failures are verified again
+	verifiedSecrets.Lock()
+	verifiedSecrets.failed[digest] = time.Now().Add(-time.Second)
+	verifiedSecrets.Unlock()
+	if VerifySecret("wrong", hash) {
+		t.Errorf("wrong secret verified after the failure expired")
+	}
+}
+
+// useTestHeadKey points the head key to a new file in a temporary directory.
+func useTestHeadKey(t *testing.T) {
+	previous := headKeyFile
+	headKeyFile = filepath.Join(t.TempDir(), "head.key")
+	t.Cleanup(func() { headKeyFile = previous })
+}
+
+func TestHeadKey(t *testing.T) {
+	useTestHeadKey(t)
+
+	sealed, err := sealHeadSecret("value")
+	if err != nil {
+		t.Fatalf("sealHeadSecret failed: %v", err)
+	}
+	if info, err := os.Stat(headKeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("head key file not created with mode 0600: %v", err)
+	}
+
+	// a restarted head reads the key from the file
+	headKey.key = nil
+	if value, err := openHeadSecret(sealed); err != nil || value != "value" {
+		t.Errorf("openHeadSecret = %q, %v, want value", value, err)
+	}
+
+	headKey.key = nil
+	if err := os.Chmod(headKeyFile, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openHeadSecret(sealed); err == nil {
+		t.Errorf("head key readable by group accepted")
+	}
+}
+
+func TestMigrateSatelliteSecrets(t *testing.T) {
+	useTestHeadKey(t)
+
+	c := Configuration{Satellites: map[string]Satellite{
+		"plain":   {Name: "plain", Secret: "secret123"},
+		"signing": {Name: "signing", Secret: "secret789", RequireSignature: true},
+		"hashed":  satelliteWithSecret("secret456", ""),
+	}}
+	hashed := c.Satellites["hashed"].SecretHash
+
+	migrated, err := migrateSatelliteSecrets(&c, nil)
+	if err != nil {
+		t.Fatalf("migrateSatelliteSecrets failed: %v", err)
+	}
+	if !migrated {
+		t.Errorf("plaintext secret not reported as migrated")
+	}
+
+	plain := c.Satellites["plain"]
+	if plain.Secret != "" {
+		t.Errorf("plaintext secret kept after migration")
+	}
+	if !VerifySecret("secret123", plain.SecretHash) {
+		t.Errorf("migrated hash does not verify")
+	}
+	if key, err := openHeadSecret(plain.SigningKey); err != nil || key != deriveSigningKey("secret123") {
+		t.Errorf("signing key not derived from secret: %v", err)
+	}
+	signing := c.Satellites["signing"]
+	if key, err := openHeadSecret(signing.SigningKey); err != nil || key != deriveSigningKey("secret789") {
+		t.Errorf("signing key not derived from secret: %v", err)
+	}
+	if c.Satellites["hashed"].SecretHash != hashed {
+		t.Errorf("already hashed secret was changed")
+	}
+
+	migrated, _ = migrateSatelliteSecrets(&c, nil)
+	if migrated {
+		t.Errorf("second migration reported changes")
+	}
+}
+
+func TestRotateSecret(t *testing.T) {
+	useTestHeadKey(t)
+
+	s := satelliteWithSecret("old-secret", "")
+	if err := s.rotateSecret("new-secret", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("rotateSecret failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		satellite  Satellite
+		secret     string
+		credential string
+	}{
+		{"new secret", s, "new-secret", CredentialSecret},
+		{"old secret within grace", s, "old-secret", CredentialPreviousSecret},
+		{"old secret after grace", func() Satellite { e := s; e.PreviousSecretExpires = time.Now().Unix() - 1; return e }(),
+			"old-secret", ""},
+		{"unrelated secret", s, "other-secret", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://head/satellites/sat1/targets", nil)
+			r.Header.Set(HeaderAuthorization, tt.secret)
+			credential, err := authenticateSatellite(r, tt.satellite)
+			if tt.credential == "" && err == nil {
+				t.Errorf("expected error but got credential %q", credential)
+			}
+			if tt.credential != "" && credential != tt.credential {
+				t.Errorf("credential = %q (error %v), want %q", credential, err, tt.credential)
+			}
+		})
+	}
+
+	// the pending secret is stored sealed with the head key, not with a key
+	// derivable from anything else in the config
+	secret, err := openHeadSecret(s.PendingSecret)
+	if err != nil || secret != "new-secret" {
+		t.Errorf("openHeadSecret = %q, %v, want new-secret", secret, err)
+	}
+	if _, err := openPendingSecret(deriveSigningKey("old-secret"), s.PendingSecret); err == nil {
+		t.Errorf("pending secret opened with the old signing key")
+	}
+
+	// setting a secret directly cancels the rotation
+	if err := s.setSecret("third-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if s.PreviousSecretHash != "" || s.PendingSecret != "" {
+		t.Errorf("rotation state kept after setSecret")
+	}
+}
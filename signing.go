@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureMaxSkew is how far a signed request's timestamp may deviate from the
+// head's clock. Nonces are remembered for the same duration.
+const signatureMaxSkew = 5 * time.Minute
+
+// signingKeyContext separates the request signing key from other uses of the
+// satellite secret.
+const signingKeyContext = "nprobe-request-signing-v1"
+
+// deriveSigningKey derives the HMAC key used for request signing from a
+// satellite secret. Both sides derive the key, so the secret itself never
+// has to be sent.
+func deriveSigningKey(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingKeyContext))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signaturePayload builds the canonical string covered by the signature.
+func signaturePayload(method, path, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		method,
+		path,
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n"))
+}
+
+func computeSignature(key string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds timestamp, nonce and signature headers to req. body must be
+// the exact payload that is sent with the request.
+func SignRequest(req *http.Request, key string, body []byte) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	req.Header.Set(HeaderNprobeTimestamp, timestamp)
+	req.Header.Set(HeaderNprobeNonce, nonce)
+	req.Header.Set(HeaderNprobeSignature,
+		computeSignature(key, signaturePayload(req.Method, req.URL.Path, timestamp, nonce, body)))
+
+	return nil
+}
+
+// VerifyRequestSignature checks the signature headers of r against key and
+// rejects timestamps outside of signatureMaxSkew. It returns the nonce so the
+// caller can check it for reuse.
+func VerifyRequestSignature(r *http.Request, key string, body []byte, now time.Time) (string, error) {
+	timestamp := r.Header.Get(HeaderNprobeTimestamp)
+	nonce := r.Header.Get(HeaderNprobeNonce)
+	signature := r.Header.Get(HeaderNprobeSignature)
+
+	if timestamp == "" || nonce == "" || signature == "" {
+		return "", errors.New("incomplete signature headers")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature timestamp: %w", err)
+	}
+
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return "", fmt.Errorf("signature timestamp outside of allowed window (skew %s)", skew.Round(time.Second))
+	}
+
+	expected := computeSignature(key, signaturePayload(r.Method, r.URL.Path, timestamp, nonce, body))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", errors.New("signature mismatch")
+	}
+
+	return nonce, nil
+}
+
+// nonceCache remembers recently seen nonces to detect replayed requests.
+// Nonces are kept in two generations of ttl each, the older one is dropped
+// as a whole, so a nonce is remembered for at least ttl without sweeping all
+// nonces on every request.
+type nonceCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	started  time.Time
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		ttl:      ttl,
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// Use records nonce and returns false if it has been used within the ttl.
+func (nc *nonceCache) Use(nonce string, now time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	switch age := now.Sub(nc.started); {
+	case age >= 2*nc.ttl:
+		nc.previous = make(map[string]struct{})
+		nc.current = make(map[string]struct{})
+		nc.started = now
+	case age >= nc.ttl:
+		nc.previous = nc.current
+		nc.current = make(map[string]struct{})
+		nc.started = nc.started.Add(nc.ttl)
+	}
+
+	if _, found := nc.current[nonce]; found {
+		return false
+	}
+	if _, found := nc.previous[nonce]; found {
+		return false
+	}
+	nc.current[nonce] = struct{}{}
+	return true
+}
+
+var usedNonces = newNonceCache(2 * signatureMaxSkew)
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestSignatureRoundTrip(t *testing.T) {
+	key := deriveSigningKey("secret123")
+	body := []byte(`{"SatelliteName":"sat1"}`)
+
+	tests := []struct {
+		name        string
+		modify      func(r *http.Request)
+		verifyKey   string
+		verifyBody  []byte
+		now         time.Time
+		expectError bool
+	}{
+		{"valid", func(r *http.Request) {}, key, body, time.Now(), false},
+		{"wrong key", func(r *http.Request) {}, deriveSigningKey("other"), body, time.Now(), true},
+		{"tampered body", func(r *http.Request) {}, key, []byte(`{"SatelliteName":"sat2"}`), time.Now(), true},
+		{"tampered method", func(r *http.Request) { r.Method = "DELETE" }, key, body, time.Now(), true},
+		{"tampered path", func(r *http.Request) { r.URL.Path = "/satellites/sat2/t1/metrics" }, key, body, time.Now(), true},
+		{"tampered nonce", func(r *http.Request) { r.Header.Set(HeaderNprobeNonce, "abc") }, key, body, time.Now(), true},
+		{"missing signature", func(r *http.Request) { r.Header.Del(HeaderNprobeSignature) }, key, body, time.Now(), true},
+		{"stale timestamp", func(r *http.Request) {}, key, body, time.Now().Add(signatureMaxSkew + time.Minute), true},
+		{"future timestamp", func(r *http.Request) {}, key, body, time.Now().Add(-signatureMaxSkew - time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("PUT", "http://head/satellites/sat1/t1/metrics", bytes.NewReader(body))
+			if err := SignRequest(r, key, body); err != nil {
+				t.Fatalf("SignRequest failed: %v", err)
+			}
+			tt.modify(r)
+
+			_, err := VerifyRequestSignature(r, tt.verifyKey, tt.verifyBody, tt.now)
+			if tt.expectError && err == nil {
+				t.Errorf("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignRequestDoesNotLeakSecret(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://head/satellites/sat1/targets", nil)
+	if err := SignRequest(r, deriveSigningKey("secret123"), nil); err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+
+	for name, values := range r.Header {
+		for _, v := range values {
+			if bytes.Contains([]byte(v), []byte("secret123")) {
+				t.Errorf("header %s contains the secret", name)
+			}
+		}
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := newNonceCache(time.Minute)
+	now := time.Now()
+
+	if !nc.Use("a", now) {
+		t.Error("first use of nonce rejected")
+	}
+	if nc.Use("a", now.Add(30*time.Second)) {
+		t.Error("reused nonce accepted within ttl")
+	}
+	if !nc.Use("b", now) {
+		t.Error("different nonce rejected")
+	}
+	if !nc.Use("a", now.Add(2*time.Minute)) {
+		t.Error("nonce rejected after ttl expired")
+	}
+	// a nonce is remembered for at least the ttl across generations
+	if !nc.Use("c", now.Add(2*time.Minute+50*time.Second)) {
+		t.Error("new nonce rejected")
+	}
+	if nc.Use("c", now.Add(3*time.Minute+40*time.Second)) {
+		t.Error("reused nonce accepted within ttl after a new generation started")
+	}
+	if len(nc.previous)+len(nc.current) > 3 {
+		t.Errorf("cache holds %d nonces, want the expired ones dropped", len(nc.previous)+len(nc.current))
+	}
+}
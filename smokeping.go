@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// smokepingTemplate is the target template holding the step and pings of the
+// smokeping Database section.
+const smokepingTemplate = "smokeping"
+
+// Defaults of the smokeping Database section.
+const (
+	smokepingStep  = 300
+	smokepingPings = 20
+)
+
+// smokepingSection matches section headers like "*** Targets ***".
+var smokepingSection = regexp.MustCompile(`^\*\*\*\s*(\w+)\s*\*\*\*$`)
+
+// smokepingNodeLine matches node lines like "++ name", the number of plus
+// signs is the level of the node.
+var smokepingNodeLine = regexp.MustCompile(`^(\++)\s*(\S+)$`)
+
+// spNode is a node of a smokeping section tree, e.g. a target, a probe or a
+// slave.
+type spNode struct {
+	Name     string
+	Vars     map[string]string
+	Parent   *spNode
+	Children []*spNode
+}
+
+// get returns the variable key of the node or, as smokeping inherits
+// variables down the Targets tree, of its closest ancestor.
+func (n *spNode) get(key string) string {
+	for node := n; node != nil; node = node.Parent {
+		if v, found := node.Vars[key]; found {
+			return v
+		}
+	}
+	return ""
+}
+
+// path returns the names of the node and its ancestors, without the root.
+func (n *spNode) path() []string {
+	var path []string
+	for node := n; node.Parent != nil; node = node.Parent {
+		path = append([]string{node.Name}, path...)
+	}
+	return path
+}
+
+// parseSmokeping reads a smokeping config or a Targets file and returns the
+// trees of its sections. Lines before the first section header belong to
+// Targets, so files included into the Targets section can be read on their
+// own. @include lines are followed, relative paths are relative to the
+// including file.
+func parseSmokeping(file string) (map[string]*spNode, error) {
+	sections := map[string]*spNode{}
+	section := "Targets"
+	var current *spNode
+
+	var read func(file string, depth int) error
+	read = func(file string, depth int) error {
+		if depth > 10 {
+			return fmt.Errorf("%s: @include nested too deep", file)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			if m := smokepingSection.FindStringSubmatch(line); m != nil {
+				section = m[1]
+				current = nil
+				continue
+			}
+
+			if strings.HasPrefix(line, "@include") {
+				include := strings.TrimSpace(strings.TrimPrefix(line, "@include"))
+				if !filepath.IsAbs(include) {
+					include = filepath.Join(filepath.Dir(file), include)
+				}
+				if err := read(include, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+
+			root := sections[section]
+			if root == nil {
+				root = &spNode{Vars: map[string]string{}}
+				sections[section] = root
+			}
+			if current == nil {
+				current = root
+			}
+
+			if m := smokepingNodeLine.FindStringSubmatch(line); m != nil {
+				level := len(m[1])
+				parent := current
+				for parent != root && len(parent.path()) >= level {
+					parent = parent.Parent
+				}
+				if len(parent.path()) != level-1 {
+					return fmt.Errorf("%s:%d: %s skips a level", file, lineNumber, m[2])
+				}
+				current = &spNode{Name: m[2], Vars: map[string]string{}, Parent: parent}
+				parent.Children = append(parent.Children, current)
+				continue
+			}
+
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				return fmt.Errorf("%s:%d: expected key = value", file, lineNumber)
+			}
+			current.Vars[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		return scanner.Err()
+	}
+
+	if err := read(file, 0); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// smokepingImport is the result of converting a smokeping config.
+type smokepingImport struct {
+	Template   ProbeDefaults
+	Targets    map[string]Target
+	Satellites map[string]Satellite
+	Warnings   []string
+}
+
+// convertSmokeping converts the smokeping sections into nprobe targets and
+// satellites. Each slave becomes a satellite probing the targets listing it
+// in slaves; the master becomes the satellite master probing all targets
+// without nomasterpoll, unless master is empty. The names of the ancestors
+// of a target become its groups, its top level section and its path become
+// the tags section and path. Targets and slaves whose names turn into the
+// name of one converted before get a numeric suffix and a warning.
+func convertSmokeping(sections map[string]*spNode, master string) smokepingImport {
+	result := smokepingImport{
+		Template:   ProbeDefaults{Interval: smokepingStep, Probes: smokepingPings},
+		Targets:    map[string]Target{},
+		Satellites: map[string]Satellite{},
+	}
+	warn := func(format string, args ...interface{}) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	if db := sections["Database"]; db != nil {
+		if step, err := strconv.Atoi(db.Vars["step"]); err == nil && step > 0 {
+			result.Template.Interval = step
+		}
+		if pings, err := strconv.Atoi(db.Vars["pings"]); err == nil && pings > 0 {
+			result.Template.Probes = pings
+		}
+	}
+
+	// probe instances by name, their module is their level one ancestor
+	probes := map[string]*spNode{}
+	var collectProbes func(n *spNode)
+	collectProbes = func(n *spNode) {
+		for _, child := range n.Children {
+			probes[child.Name] = child
+			collectProbes(child)
+		}
+	}
+	if p := sections["Probes"]; p != nil {
+		collectProbes(p)
+	}
+
+	satellite := func(name string) Satellite {
+		s, found := result.Satellites[name]
+		if !found {
+			s = Satellite{Name: name, Active: true, Targets: []string{}}
+		}
+		return s
+	}
+	// unique returns name, or name with the first free numeric suffix if
+	// taken reports it is used already
+	unique := func(name string, taken func(string) bool) string {
+		free := name
+		for i := 2; taken(free); i++ {
+			free = fmt.Sprintf("%s-%d", name, i)
+		}
+		return free
+	}
+	satelliteTaken := func(name string) bool {
+		_, found := result.Satellites[name]
+		return found
+	}
+
+	if master != "" {
+		result.Satellites[master] = satellite(master)
+	}
+	// nprobe names of the slaves by their smokeping name
+	slaveNames := map[string]string{}
+	if slaves := sections["Slaves"]; slaves != nil {
+		for _, slave := range slaves.Children {
+			name := unique(smokepingName(slave.Name), satelliteTaken)
+			if name != smokepingName(slave.Name) {
+				warn("Slaves/%s: satellite %s already exists, importing the slave as %s", slave.Name, smokepingName(slave.Name), name)
+			}
+			slaveNames[slave.Name] = name
+			result.Satellites[name] = satellite(name)
+		}
+	}
+
+	var convert func(n *spNode)
+	convert = func(n *spNode) {
+		for _, child := range n.Children {
+			convert(child)
+		}
+
+		host := n.Vars["host"]
+		if host == "" || n.Parent == nil {
+			return
+		}
+		path := n.path()
+		name := smokepingName(strings.Join(path, "-"))
+		if strings.HasPrefix(host, "/") {
+			warn("%s: skipping multi-host graph", strings.Join(path, "/"))
+			return
+		}
+		if err := ValidateIdentifier(name, "target name"); err != nil {
+			warn("%s: %v", strings.Join(path, "/"), err)
+			return
+		}
+
+		probeName := n.get("probe")
+		probe := probes[probeName]
+		module := probeName
+		for p := probe; p != nil && p.Parent != nil; p = p.Parent {
+			module = p.Name
+		}
+
+		// probe variables can be set by the target or the probe
+		setting := func(key string) string {
+			if v := n.get(key); v != "" || probe == nil {
+				return v
+			}
+			return probe.get(key)
+		}
+
+		target := Target{Name: name, Template: smokepingTemplate, Tags: map[string]string{}}
+		switch module {
+		case "FPing", "FPing6":
+			target.ProbeType = "icmp"
+			target.Host = host
+		case "EchoPingHttp", "EchoPingHttps":
+			target.ProbeType = "http"
+			scheme, port := "http", "80"
+			if module == "EchoPingHttps" {
+				scheme, port = "https", "443"
+			}
+			if p := setting("port"); p != "" && p != port {
+				host = host + ":" + p
+			}
+			target.Host = scheme + "://" + host + "/" + strings.TrimPrefix(setting("url"), "/")
+		case "Curl":
+			target.ProbeType = "http"
+			format := setting("urlformat")
+			if format == "" {
+				format = "http://%host%/"
+			}
+			target.Host = strings.ReplaceAll(format, "%host%", host)
+		default:
+			warn("%s: skipping target, probe %s (%s) is not supported", strings.Join(path, "/"), probeName, module)
+			return
+		}
+
+		if probe != nil {
+			if pings, err := strconv.Atoi(probe.get("pings")); err == nil && pings > 0 {
+				target.Probes = pings
+			}
+		}
+
+		for _, ancestor := range path[:len(path)-1] {
+			target.Groups = append(target.Groups, smokepingName(ancestor))
+		}
+		target.Tags["section"] = smokepingName(path[0])
+		target.Tags["path"] = strings.Join(path, "/")
+		target.Name = unique(name, func(name string) bool {
+			_, found := result.Targets[name]
+			return found
+		})
+		if target.Name != name {
+			warn("%s: target %s already exists, importing the target as %s", strings.Join(path, "/"), name, target.Name)
+			name = target.Name
+		}
+		result.Targets[name] = target
+
+		if master != "" && n.get("nomasterpoll") != "yes" {
+			s := result.Satellites[master]
+			s.Targets = append(s.Targets, name)
+			result.Satellites[master] = s
+		}
+		for _, slave := range strings.Fields(n.get("slaves")) {
+			satelliteName, found := slaveNames[slave]
+			if !found {
+				satelliteName = smokepingName(slave)
+			}
+			s := satellite(satelliteName)
+			s.Targets = append(s.Targets, name)
+			result.Satellites[s.Name] = s
+		}
+	}
+	if t := sections["Targets"]; t != nil {
+		convert(t)
+	}
+
+	for name, s := range result.Satellites {
+		sort.Strings(s.Targets)
+		result.Satellites[name] = s
+	}
+	return result
+}
+
+// smokepingName turns a smokeping node name into an nprobe name.
+func smokepingName(name string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-._")
+}
+
+// importSmokepingCommand implements "nprobe import-smokeping". It converts a
+// smokeping config into targets and satellites and adds them to a config
+// file, which is created if it doesn't exist. It returns the exit code.
+func importSmokepingCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import-smokeping", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	targetsFile := flags.String("targets", "", "smokeping config or Targets file")
+	configFile := flags.String("config", "config/config.json", "config file to add the targets and satellites to")
+	master := flags.String("master", "master", "satellite for the targets the smokeping master probes, empty to skip them")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *targetsFile == "" {
+		fmt.Fprintln(stderr, "-targets is required")
+		return 2
+	}
+
+	sections, err := parseSmokeping(*targetsFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	imported := convertSmokeping(sections, *master)
+	for _, w := range imported.Warnings {
+		fmt.Fprintf(stderr, "%s: %s\n", *targetsFile, w)
+	}
+
+	// references like ${INFLUXDB_TOKEN} are kept as they are
+	v := viper.New()
+	v.SetConfigType(configType(*configFile))
+	if _, err := os.Stat(*configFile); err == nil {
+		v.SetConfigFile(*configFile)
+		if err := v.ReadInConfig(); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *configFile, err)
+			return 1
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		v.Set("listen_port", "8000")
+	} else {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var c Configuration
+	if err := v.Unmarshal(&c); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+	normalizeConfig(&c)
+
+	conflicts := 0
+	conflict := func(kind string, name string) {
+		fmt.Fprintf(stderr, "%s: %s %s already exists\n", *configFile, kind, name)
+		conflicts++
+	}
+	if c.TargetTemplates == nil {
+		c.TargetTemplates = make(map[string]ProbeDefaults)
+	}
+	if existing, found := c.TargetTemplates[smokepingTemplate]; found && existing != imported.Template {
+		conflict("target template", smokepingTemplate)
+	}
+	c.TargetTemplates[smokepingTemplate] = imported.Template
+	if c.Targets == nil {
+		c.Targets = make(map[string]Target)
+	}
+	for name, t := range imported.Targets {
+		if _, found := c.Targets[name]; found {
+			conflict("target", name)
+		}
+		c.Targets[name] = t
+	}
+	if c.Satellites == nil {
+		c.Satellites = make(map[string]Satellite)
+	}
+	secrets := map[string]string{}
+	for name, s := range imported.Satellites {
+		if _, found := c.Satellites[name]; found {
+			conflict("satellite", name)
+			continue
+		}
+		secrets[name] = RandomString(20)
+		if err := s.setSecret(secrets[name]); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		c.Satellites[name] = s
+	}
+	if conflicts > 0 {
+		return 1
+	}
+
+	if errs := validateConfig(&c); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(stderr, "%s: %s\n", *configFile, e)
+		}
+		return 1
+	}
+
+	v.Set("target_templates", configSection(c.TargetTemplates))
+	v.Set("targets", configSection(c.Targets))
+	v.Set("satellites", configSection(c.Satellites))
+	if err := v.WriteConfigAs(*configFile); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: imported %d targets and %d satellites\n", *configFile, len(imported.Targets), len(secrets))
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(stdout, "satellite %s: secret %s\n", name, secrets[name])
+	}
+	return 0
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSmokepingConfig = `
+*** Database ***
+step = 60
+pings = 10
+
+*** Probes ***
++ FPing
+binary = /usr/bin/fping
+
++ EchoPingHttp
+++ EchoPingHttpAlt
+port = 8080
+
++ DNS
+binary = /usr/bin/dig
+
+*** Slaves ***
+secrets = /etc/smokeping/slave-secrets
+
++ Boomer
+display_name = boomer
+
+*** Targets ***
+probe = FPing
+menu = Top
+title = Network Latency
+
+@include targets.d/local
+`
+
+const testSmokepingTargets = `
++ Local
+menu = Local
+slaves = boomer
+
+++ Router
+host = 192.168.1.1
+
+++ Intranet
+probe = EchoPingHttpAlt
+host = intranet.example.com
+url = /status
+nomasterpoll = yes
+
+++ Resolver
+probe = DNS
+host = 192.168.1.53
+
++ Remote
+++ Sites
++++ Example
+host = example.com
+`
+
+func TestImportSmokeping(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "targets.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "smokeping.conf"), []byte(testSmokepingConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "targets.d", "local"), []byte(testSmokepingTargets), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-targets", filepath.Join(dir, "smokeping.conf"), "-config", configFile}
+	if code := importSmokepingCommand(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("importSmokepingCommand() = %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Local/Resolver: skipping target, probe DNS (DNS) is not supported") {
+		t.Errorf("no warning about the DNS probe: %s", stderr.String())
+	}
+
+	if problems, err := validateConfigFile(configFile, true); err != nil || len(problems) > 0 {
+		t.Fatalf("imported config is invalid: %v %v", err, problems)
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := readConfig(data, "json", resolveReference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []struct {
+		name      string
+		host      string
+		probeType string
+		groups    string
+		tags      string
+	}{
+		{"local-router", "192.168.1.1", "icmp", "local", "local,Local/Router"},
+		{"local-intranet", "http://intranet.example.com:8080/status", "http", "local", "local,Local/Intranet"},
+		{"remote-sites-example", "example.com", "icmp", "remote,sites", "remote,Remote/Sites/Example"},
+	}
+
+	if len(c.Targets) != len(targets) {
+		t.Errorf("targets = %d, want %d", len(c.Targets), len(targets))
+	}
+	for _, tt := range targets {
+		t.Run(tt.name, func(t *testing.T) {
+			target, found := c.Targets[tt.name]
+			if !found {
+				t.Fatalf("target %s not imported", tt.name)
+			}
+			if target.Host != tt.host || target.ProbeType != tt.probeType {
+				t.Errorf("target = %s %s, want %s %s", target.Host, target.ProbeType, tt.host, tt.probeType)
+			}
+			if groups := strings.Join(target.Groups, ","); groups != tt.groups {
+				t.Errorf("groups = %s, want %s", groups, tt.groups)
+			}
+			if tags := target.Tags["section"] + "," + target.Tags["path"]; tags != tt.tags {
+				t.Errorf("tags = %s, want %s", tags, tt.tags)
+			}
+		})
+	}
+
+	if template := c.TargetTemplates[smokepingTemplate]; template.Interval != 60 || template.Probes != 10 {
+		t.Errorf("template = %+v, want interval 60 and 10 probes", template)
+	}
+
+	satellites := map[string]string{
+		"master": "local-router,remote-sites-example",
+		"boomer": "local-intranet,local-router",
+	}
+	for name, expected := range satellites {
+		s, found := c.Satellites[name]
+		if !found {
+			t.Errorf("satellite %s not imported", name)
+			continue
+		}
+		if targets := strings.Join(s.Targets, ","); targets != expected {
+			t.Errorf("satellite %s targets = %s, want %s", name, targets, expected)
+		}
+		if s.SecretHash == "" || !strings.Contains(stdout.String(), "satellite "+name+": secret ") {
+			t.Errorf("satellite %s has no secret", name)
+		}
+	}
+
+	// importing again conflicts with the imported targets
+	stderr.Reset()
+	if code := importSmokepingCommand(args, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "target local-router already exists") {
+		t.Errorf("second import = %d: %s", code, stderr.String())
+	}
+}
+
+func TestConvertSmokepingNameCollisions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "smokeping.conf")
+	config := `
+*** Probes ***
++ FPing
+
+*** Slaves ***
++ Boomer
++ boomer
+
+*** Targets ***
+probe = FPing
+
++ A-B
+++ C
+host = 192.168.1.1
+slaves = Boomer
+
++ A
+++ B-C
+host = 192.168.1.2
+slaves = boomer
+`
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sections, err := parseSmokeping(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := convertSmokeping(sections, "")
+
+	if first, second := imported.Targets["a-b-c"], imported.Targets["a-b-c-2"]; first.Host != "192.168.1.1" || second.Host != "192.168.1.2" || second.Name != "a-b-c-2" {
+		t.Errorf("targets = %+v, want a-b-c and a-b-c-2", imported.Targets)
+	}
+	satellites := map[string]string{"boomer": "a-b-c", "boomer-2": "a-b-c-2"}
+	if len(imported.Satellites) != len(satellites) {
+		t.Errorf("satellites = %+v, want %d", imported.Satellites, len(satellites))
+	}
+	for name, expected := range satellites {
+		if targets := strings.Join(imported.Satellites[name].Targets, ","); targets != expected {
+			t.Errorf("satellite %s targets = %s, want %s", name, targets, expected)
+		}
+	}
+	warnings := strings.Join(imported.Warnings, "\n")
+	for _, expected := range []string{
+		"Slaves/boomer: satellite boomer already exists, importing the slave as boomer-2",
+		"A/B-C: target a-b-c already exists, importing the target as a-b-c-2",
+	} {
+		if !strings.Contains(warnings, expected) {
+			t.Errorf("warnings = %q, want %q", warnings, expected)
+		}
+	}
+
+	// the RRD files of a renamed target are found by its path
+	c := Configuration{Targets: imported.Targets, Satellites: imported.Satellites}
+	if _, target, err := rrdTarget(&c, "A/B-C~Boomer", ""); err != nil || target.Name != "a-b-c-2" {
+		t.Errorf("rrdTarget(A/B-C) = %s, %v, want a-b-c-2", target.Name, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// spoolDir holds the results a stopping satellite couldn't submit, set by
+// --spool-dir. They are submitted when the satellite starts again.
+var spoolDir string
+
+// defaultSpoolDir returns nprobe below the cache directory of the user, or
+// nothing to discard the results if the user has none.
+func defaultSpoolDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "nprobe")
+}
+
+// checkSpoolDir creates the spool directory if needed. A directory that is
+// not owned by the current user or accessible by others is refused, as they
+// could plant results or links in it.
+func checkSpoolDir() error {
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(spoolDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("spool directory %s is not a directory", spoolDir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("spool directory %s is not owned by the current user", spoolDir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("spool directory %s is accessible by group or others", spoolDir)
+	}
+	return nil
+}
+
+// spoolProbes writes r to the spool directory.
+func spoolProbes(r ResponsePacket) {
+	fields := logrus.Fields{"target": r.TargetName, "probes": len(r.Probes)}
+	if spoolDir == "" {
+		log.WithFields(fields).Error("No spool directory. Discarding results.")
+		return
+	}
+
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = checkSpoolDir()
+	}
+	file := filepath.Join(spoolDir, fmt.Sprintf("%d-%s.json", time.Now().UnixNano(), r.TargetName))
+	if err == nil {
+		// written under a temporary name, so a half written file is never submitted
+		err = os.WriteFile(file+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Error("Failed to spool results. Discarding results.")
+		return
+	}
+
+	fields["file"] = file
+	log.WithFields(fields).Info("Spooled results")
+}
+
+// submitSpool submits the results spooled by satellite in a previous run to
+// the head at headUrl. Results spooled again, e.g. because ctx is done
+// before the head could be reached, are kept for the next run.
+func submitSpool(ctx context.Context, headUrl string, satellite string) {
+	if spoolDir == "" {
+		return
+	}
+	if err := checkSpoolDir(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Not submitting spooled results")
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(spoolDir, "*.json"))
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error("Failed to read spool directory")
+		return
+	}
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var r ResponsePacket
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &r)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"file": file, "error": err}).Error("Failed to read spooled results")
+			continue
+		}
+		if r.SatelliteName != satellite {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.WithFields(logrus.Fields{"file": file, "error": err}).Error("Failed to remove spooled results")
+			continue
+		}
+
+		log.WithFields(logrus.Fields{"file": file, "target": r.TargetName}).Info("Submitting spooled results")
+		submitProbes(ctx, r, headUrl+"satellites/"+r.SatelliteName+"/"+r.TargetName+"/metrics")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	spoolDir = t.TempDir()
+	t.Cleanup(func() { spoolDir = "" })
+	if err := os.Chmod(spoolDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var submitted []ResponsePacket
+	head := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var packet ResponsePacket
+		if err := json.NewDecoder(r.Body).Decode(&packet); err != nil || r.URL.Path != "/satellites/sat1/web/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		mutex.Lock()
+		submitted = append(submitted, packet)
+		mutex.Unlock()
+	}))
+	defer head.Close()
+
+	probes := []Probe{{Median: 1.5, NumProbes: 5, Timestamp: time.Unix(1700000000, 0).UTC()}}
+	spoolProbes(ResponsePacket{SatelliteName: "sat1", TargetName: "web", ProbeType: "http", Probes: probes})
+	spoolProbes(ResponsePacket{SatelliteName: "other", TargetName: "web", ProbeType: "http", Probes: probes})
+
+	submitSpool(context.Background(), head.URL+"/", "sat1")
+
+	mutex.Lock()
+	if len(submitted) != 1 || submitted[0].Probes[0] != probes[0] {
+		t.Errorf("submitted = %+v, want the spooled results of sat1", submitted)
+	}
+	mutex.Unlock()
+	if files, _ := filepath.Glob(filepath.Join(spoolDir, "*.json")); len(files) != 1 {
+		t.Errorf("spool holds %d files, want the one of the other satellite", len(files))
+	}
+
+	// results that can't be submitted when stopping are spooled again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	submitProbes(ctx, ResponsePacket{SatelliteName: "sat1", TargetName: "web", Probes: probes}, "http://127.0.0.1:1/satellites/sat1/web/metrics")
+	if files, _ := filepath.Glob(filepath.Join(spoolDir, "*.json")); len(files) != 2 {
+		t.Errorf("spool holds %d files, want 2", len(files))
+	}
+
+	// results the head doesn't take after all retries are spooled as well
+	delay := retryTimer
+	retryTimer = time.Millisecond
+	t.Cleanup(func() { retryTimer = delay })
+	submitProbes(context.Background(), ResponsePacket{SatelliteName: "sat1", TargetName: "web", Probes: probes}, "http://127.0.0.1:1/satellites/sat1/web/metrics")
+	if files, _ := filepath.Glob(filepath.Join(spoolDir, "*.json")); len(files) != 3 {
+		t.Errorf("spool holds %d files after the retries ran out, want 3", len(files))
+	}
+}
+
+func TestCheckSpoolDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { spoolDir = "" })
+
+	spoolDir = filepath.Join(dir, "spool")
+	if err := checkSpoolDir(); err != nil {
+		t.Fatalf("checkSpoolDir() error = %v", err)
+	}
+	if info, err := os.Stat(spoolDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("spool directory not created with mode 0700: %v", err)
+	}
+
+	if err := os.Chmod(spoolDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSpoolDir(); err == nil {
+		t.Errorf("spool directory accessible by group accepted")
+	}
+
+	spoolDir = filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "spool"), spoolDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSpoolDir(); err == nil {
+		t.Errorf("link to a spool directory accepted")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minSRVRefresh is the shortest time SRV records are cached, regardless of
+// their TTL.
+const minSRVRefresh = 5 * time.Second
+
+// srvRetry is the time after which a failed SRV lookup is retried.
+const srvRetry = 30 * time.Second
+
+const dnsTimeout = 5 * time.Second
+
+// nameservers returns the DNS servers SRV records are looked up with.
+var nameservers = systemNameservers
+
+// srvSource is the key of the targets expanded from SRV target name in
+// Configuration.Discovered. Discovery names can't contain a colon.
+func srvSource(name string) string {
+	return "srv:" + name
+}
+
+// systemNameservers returns the nameservers of /etc/resolv.conf.
+func systemNameservers() []string {
+	var servers []string
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// lookupSRV returns the SRV records of name, ordered by priority and weight,
+// and the lowest TTL of the answers. A name that doesn't exist has no
+// records. The standard resolver is not used as it doesn't return TTLs.
+func lookupSRV(name string) ([]dnsmessage.SRVResource, time.Duration, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range nameservers() {
+		response, err := exchangeDNS("udp", server, packed)
+		if err == nil && response.Header.Truncated {
+			response, err = exchangeDNS("tcp", server, packed)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Header.ID != query.Header.ID {
+			lastErr = fmt.Errorf("%s answered with wrong id", server)
+			continue
+		}
+
+		switch response.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, srvRetry, nil
+		default:
+			lastErr = fmt.Errorf("%s answered %s", server, response.Header.RCode)
+			continue
+		}
+
+		var records []dnsmessage.SRVResource
+		ttl := time.Duration(0)
+		for _, answer := range response.Answers {
+			srv, ok := answer.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			records = append(records, *srv)
+			if t := time.Duration(answer.Header.TTL) * time.Second; ttl == 0 || t < ttl {
+				ttl = t
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			return records[i].Weight > records[j].Weight
+		})
+		return records, ttl, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+// exchangeDNS sends a packed query to server over network (udp or tcp) and
+// returns the parsed response.
+func exchangeDNS(network string, server string, query []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// messages over TCP are prefixed with their length
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// srvTargets expands target into one target per SRV record. The expanded
+// targets are named "<target>-<host>-<port>" and inherit all settings of
+// target. HTTP targets are probed at https://<host>:<port> for _https
+// services and http://<host>:<port> otherwise, other probes don't use ports.
+func srvTargets(target Target, records []dnsmessage.SRVResource) map[string]Target {
+	targets := map[string]Target{}
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target.String(), ".")
+		if host == "" {
+			// "." announces that the service is not available
+			continue
+		}
+		port := strconv.Itoa(int(record.Port))
+
+		name := target.Name + "-" + strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(host), "-"), "-._") + "-" + port
+		if err := ValidateIdentifier(name, "target name"); err != nil {
+			log.WithFields(logrus.Fields{"target": target.Name, "host": host, "error": err}).Warn("Skipping SRV record")
+			continue
+		}
+
+		expanded := target
+		expanded.Name = name
+		expanded.SRV = ""
+		expanded.Host = host
+		if target.ProbeType == "http" {
+			scheme := "http"
+			if strings.HasPrefix(target.SRV, "_https.") {
+				scheme = "https"
+			}
+			expanded.Host = scheme + "://" + net.JoinHostPort(host, port)
+		}
+		targets[name] = expanded
+	}
+	return targets
+}
+
+// refreshSRV looks up the SRV records of target and replaces the targets
+// expanded from it, unless ctx is done meanwhile. It returns when the records
+// should be looked up again, which is after their TTL. If the lookup fails the
+// previous targets are kept.
+func refreshSRV(ctx context.Context, target Target) time.Duration {
+	records, ttl, err := lookupSRV(target.SRV)
+	if err != nil {
+		log.WithFields(logrus.Fields{"target": target.Name, "srv": target.SRV, "error": err}).Warn("SRV lookup failed, keeping previous targets")
+		return srvRetry
+	}
+	targets := srvTargets(target, records)
+
+	cMutex.Lock()
+	if ctx.Err() != nil {
+		cMutex.Unlock()
+		return srvRetry
+	}
+	if Config.Discovered == nil {
+		Config.Discovered = make(map[string]map[string]Target)
+	}
+	Config.Discovered[srvSource(target.Name)] = targets
+	cMutex.Unlock()
+
+	log.WithFields(logrus.Fields{"target": target.Name, "srv": target.SRV, "targets": len(targets), "ttl": ttl}).Debug("SRV records refreshed")
+	return max(ttl, minSRVRefresh)
+}
+
+// validateSRV checks the SRV name of a target.
+func validateSRV(srv string) error {
+	if !strings.HasPrefix(srv, "_") {
+		return errors.New("srv must be a service name like _https._tcp.example.com")
+	}
+	_, err := dnsmessage.NewName(strings.TrimSuffix(srv, ".") + ".")
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers SRV queries for _https._tcp.example.com. and NXDOMAIN for
+// all other names.
+func fakeDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: query.Questions,
+			}
+			question := query.Questions[0]
+			if question.Name.String() == "_https._tcp.example.com." {
+				for i, r := range []struct {
+					host     string
+					priority uint16
+					ttl      uint32
+				}{{"web2.example.com.", 20, 300}, {"web1.example.com.", 10, 60}} {
+					response.Answers = append(response.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: r.ttl},
+						Body:   &dnsmessage.SRVResource{Priority: r.priority, Port: uint16(443 + i), Target: dnsmessage.MustNewName(r.host)},
+					})
+				}
+			} else {
+				response.Header.RCode = dnsmessage.RCodeNameError
+			}
+
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSRVTargets(t *testing.T) {
+	server := fakeDNS(t)
+	nameservers = func() []string { return []string{server} }
+	t.Cleanup(func() { nameservers = systemNameservers })
+
+	tests := []struct {
+		name    string
+		srv     string
+		records []string
+		ttl     time.Duration
+	}{
+		{"ordered by priority", "_https._tcp.example.com", []string{"web1.example.com.", "web2.example.com."}, time.Minute},
+		{"unknown name", "_https._tcp.example.org", nil, srvRetry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, ttl, err := lookupSRV(tt.srv)
+			if err != nil {
+				t.Fatalf("lookupSRV() error = %v", err)
+			}
+			var hosts []string
+			for _, r := range records {
+				hosts = append(hosts, r.Target.String())
+			}
+			if strings.Join(hosts, ",") != strings.Join(tt.records, ",") {
+				t.Errorf("lookupSRV() = %v, want %v", hosts, tt.records)
+			}
+			if ttl != tt.ttl {
+				t.Errorf("ttl = %v, want %v", ttl, tt.ttl)
+			}
+		})
+	}
+
+	api := Target{Name: "api", SRV: "_https._tcp.example.com", ProbeType: "http", Tags: map[string]string{"env": "prod"}}
+	cMutex.Lock()
+	Config = Configuration{Targets: map[string]Target{"api": api}}
+	cMutex.Unlock()
+
+	if refresh := refreshSRV(context.Background(), api); refresh != time.Minute {
+		t.Errorf("refreshSRV() = %v, want %v", refresh, time.Minute)
+	}
+
+	cMutex.RLock()
+	listed := resolveTargets(&Config, Satellite{Name: "sat1", Targets: []string{"api"}})
+	selected := resolveTargets(&Config, Satellite{Name: "sat2", TargetSelectors: []string{"env=prod"}})
+	cMutex.RUnlock()
+
+	var hosts []string
+	for _, target := range listed {
+		hosts = append(hosts, target.Name+"="+target.Host)
+	}
+	expected := "api-web1.example.com-444=https://web1.example.com:444,api-web2.example.com-443=https://web2.example.com:443"
+	if strings.Join(hosts, ",") != expected {
+		t.Errorf("resolveTargets() = %v, want %s", hosts, expected)
+	}
+	if len(selected) != 2 {
+		t.Errorf("resolveTargets() with selector = %d targets, want 2", len(selected))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// TargetPacket is a target as shown by the API. Discovered targets can't be
+// changed through the API, they are replaced on each refresh of their
+// discovery.
+type TargetPacket struct {
+	Target
+	Discovery string `json:",omitempty"`
+	ReadOnly  bool
+}
+
+// targetPacket returns the API view of target. Callers hold cMutex.
+func targetPacket(c *Configuration, target Target) TargetPacket {
+	discovery := c.discoveredBy(target.Name)
+	return TargetPacket{Target: target, Discovery: discovery, ReadOnly: discovery != ""}
+}
+
+// ListTargets returns the configured and the discovered targets.
+func ListTargets(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	targets := []TargetPacket{}
+	for _, target := range Config.allTargets() {
+		targets = append(targets, targetPacket(&Config, target))
+	}
+	cMutex.RUnlock()
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	err := json.NewEncoder(w).Encode(targets)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func GetTarget(w http.ResponseWriter, r *http.Request) {
+	targetName := chi.URLParam(r, "name")
+
+	// Validate target name
+	if err := ValidateIdentifier(targetName, "target name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid target name", err)
+		return
+	}
+
+	var packet TargetPacket
+	found := false
+
+	cMutex.RLock()
+	for name, target := range Config.allTargets() {
+		if name == targetName {
+			packet = targetPacket(&Config, target)
+			found = true
+			break
+		}
+	}
+	cMutex.RUnlock()
+
+	if !found {
+		handleError(w, http.StatusNotFound, r.RequestURI, "Requested item not found", nil)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(packet)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
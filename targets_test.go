@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetAdmin(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	cMutex.Lock()
+	Config = Configuration{
+		AuditLog: filepath.Join(dir, "audit.log"),
+		Satellites: map[string]Satellite{
+			"sat1": {Name: "sat1", Targets: []string{"server1"}},
+		},
+		Targets: map[string]Target{
+			"server1": {Name: "server1", Host: "foo.example.com"},
+		},
+		Discovered: map[string]map[string]Target{
+			"cmdb": {"cmdb-web1": {Name: "cmdb-web1", Host: "web1.example.com"}},
+		},
+	}
+	cMutex.Unlock()
+
+	request := func(method string, name string, body string) int {
+		r := withNameParam(httptest.NewRequest(method, "/targets/x", strings.NewReader(body)), name)
+		w := httptest.NewRecorder()
+		switch method {
+		case "PUT":
+			CreateTarget(w, r)
+		case "PATCH":
+			UpdateTarget(w, r)
+		case "DELETE":
+			DeleteTarget(w, r)
+		}
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"create", "PUT", "server2", `{"Host": "bar.example.com", "Tags": {"env": "prod"}}`, 200},
+		{"create existing", "PUT", "server2", `{"Host": "bar.example.com"}`, 400},
+		{"create without host", "PUT", "server3", `{}`, 422},
+		{"create discovered", "PUT", "cmdb-web1", `{"Host": "web1.example.com"}`, 409},
+		{"update", "PATCH", "server2", `{"Interval": 30}`, 200},
+		{"update invalid", "PATCH", "server2", `{"ProbeType": "smoke"}`, 422},
+		{"update unknown", "PATCH", "server9", `{"Interval": 30}`, 400},
+		{"update discovered", "PATCH", "cmdb-web1", `{"Interval": 30}`, 409},
+		{"delete in use", "DELETE", "server1", ``, 422},
+		{"delete", "DELETE", "server2", ``, 200},
+		{"delete unknown", "DELETE", "server2", ``, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := request(tt.method, tt.target, tt.body); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			if tt.name == "update" {
+				cMutex.RLock()
+				defer cMutex.RUnlock()
+				target := Config.Targets["server2"]
+				if target.Interval != 30 || target.Host != "bar.example.com" || target.Tags["env"] != "prod" {
+					t.Errorf("fields not part of the request changed: %+v", target)
+				}
+			}
+		})
+	}
+
+	cMutex.RLock()
+	defer cMutex.RUnlock()
+	if _, found := Config.Targets["server2"]; found {
+		t.Errorf("deleted target still configured")
+	}
+	if _, found := Config.Targets["server1"]; !found {
+		t.Errorf("target in use was deleted")
+	}
+}
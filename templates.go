@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TargetOverride changes a target for a single satellite, e.g. to probe a
+// different address of the target from inside a split-horizon DNS zone.
+// Unset settings keep the value of the target.
+type TargetOverride struct {
+	// Host replaces the host of the target
+	Host      string `mapstructure:"host,omitempty"`
+	Probes    int    `mapstructure:"probes,omitempty"`
+	Interval  int    `mapstructure:"interval,omitempty"`
+	BatchSize int    `mapstructure:"batch_size,omitempty"`
+}
+
+// applyTo sets the settings of the override on target.
+func (o TargetOverride) applyTo(target *Target) {
+	if o.Host != "" {
+		target.Host = o.Host
+	}
+	if o.Probes != 0 {
+		target.Probes = o.Probes
+	}
+	if o.Interval != 0 {
+		target.Interval = o.Interval
+	}
+	if o.BatchSize != 0 {
+		target.BatchSize = o.BatchSize
+	}
+}
+
+// resolveTarget returns target as satellite probes it. Settings are taken
+// from, in this order: the overrides of the satellite, the target, the
+// template of the target, the defaults of the satellite groups in the order
+// the satellite lists them and the builtin defaults. Callers hold cMutex.
+func resolveTarget(c *Configuration, satellite Satellite, target Target) Target {
+	if o, found := satellite.Overrides[target.Name]; found {
+		o.applyTo(&target)
+	}
+	if template, found := c.TargetTemplates[target.Template]; found {
+		template.applyTo(&target)
+	}
+	for _, name := range satellite.Groups {
+		c.SatelliteGroups[name].Defaults.applyTo(&target)
+	}
+	builtinProbeDefaults.applyTo(&target)
+
+	return target
+}
+
+// validateOverrides checks the target overrides of satellite s.
+func validateOverrides(c *Configuration, s Satellite) []ConfigError {
+	var errs []ConfigError
+	add := func(path string, err error) {
+		errs = append(errs, ConfigError{Path: path, Err: err})
+	}
+
+	for name, o := range s.Overrides {
+		path := "satellites." + s.Name + ".overrides." + name
+		if !overridableTarget(c, name) {
+			add(path, fmt.Errorf("target %s is not defined nor found by a discovery or SRV lookup", name))
+		}
+		if o.Interval < 0 {
+			add(path+".interval", errors.New("interval must be positive"))
+		}
+		if o.Probes < 0 {
+			add(path+".probes", errors.New("probes must be positive"))
+		}
+		if o.BatchSize < 0 {
+			add(path+".batch_size", errors.New("batch size must be positive"))
+		}
+	}
+
+	return errs
+}
+
+// overridableTarget reports whether name is a configured or discovered
+// target, or a target a discovery or an SRV target may find later, as the
+// names of those start with the name of their source.
+func overridableTarget(c *Configuration, name string) bool {
+	for n := range c.allTargets() {
+		if n == name {
+			return true
+		}
+	}
+	for d := range c.Discovery {
+		if strings.HasPrefix(name, d+"-") {
+			return true
+		}
+	}
+	for n, t := range c.Targets {
+		if t.SRV != "" && strings.HasPrefix(name, n+"-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveTarget(t *testing.T) {
+	c := &Configuration{
+		SatelliteGroups: map[string]SatelliteGroup{
+			"eu": {Name: "eu", Defaults: ProbeDefaults{Interval: 60, BatchSize: 2}},
+		},
+		TargetTemplates: map[string]ProbeDefaults{
+			"standard-icmp": {ProbeType: "icmp", Probes: 20, Interval: 15},
+		},
+	}
+
+	web := Target{Name: "web1", Host: "web1.example.com", ProbeType: "http", Template: "standard-icmp"}
+
+	tests := []struct {
+		name      string
+		satellite Satellite
+		target    Target
+		expected  Target
+	}{
+		{"builtin defaults", Satellite{}, Target{Name: "dns1", Host: "dns1"},
+			Target{Name: "dns1", Host: "dns1", ProbeType: DefaultProbeType, Probes: DefaultProbes, Interval: DefaultInterval, BatchSize: DefaultBatchSize}},
+		{"template before group defaults", Satellite{Groups: []string{"eu"}}, web,
+			Target{Name: "web1", Host: "web1.example.com", ProbeType: "http", Probes: 20, Interval: 15, BatchSize: 2, Template: "standard-icmp"}},
+		{"override wins", Satellite{Overrides: map[string]TargetOverride{"web1": {Host: "10.0.0.1", Interval: 120}}}, web,
+			Target{Name: "web1", Host: "10.0.0.1", ProbeType: "http", Probes: 20, Interval: 120, BatchSize: DefaultBatchSize, Template: "standard-icmp"}},
+		{"override of other target", Satellite{Overrides: map[string]TargetOverride{"web2": {Host: "10.0.0.2"}}}, web,
+			Target{Name: "web1", Host: "web1.example.com", ProbeType: "http", Probes: 20, Interval: 15, BatchSize: DefaultBatchSize, Template: "standard-icmp"}},
+		{"unknown template", Satellite{}, Target{Name: "x", Host: "x", Template: "gone"},
+			Target{Name: "x", Host: "x", ProbeType: DefaultProbeType, Probes: DefaultProbes, Interval: DefaultInterval, BatchSize: DefaultBatchSize, Template: "gone"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveTarget(c, tt.satellite, tt.target)
+			want := tt.expected
+			if got.Host != want.Host || got.ProbeType != want.ProbeType || got.Probes != want.Probes ||
+				got.Interval != want.Interval || got.BatchSize != want.BatchSize || got.Template != want.Template {
+				t.Errorf("resolveTarget() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
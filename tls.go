@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Values for Satellite.CertificateAuth. Without a value client certificates
+// are ignored and the satellite authenticates by secret only.
+const (
+	// CertificateAuthSufficient accepts a matching client certificate instead of the secret.
+	CertificateAuthSufficient = "sufficient"
+	// CertificateAuthRequired demands a matching client certificate in addition to the secret.
+	CertificateAuthRequired = "required"
+)
+
+// ValidateCertificateAuth checks that mode is a known certificate_auth value.
+func ValidateCertificateAuth(mode string) error {
+	switch mode {
+	case "", CertificateAuthSufficient, CertificateAuthRequired:
+		return nil
+	}
+	return fmt.Errorf("unknown certificate_auth %q - use %q or %q",
+		mode, CertificateAuthSufficient, CertificateAuthRequired)
+}
+
+// headTLSConfig builds the server side TLS configuration. Client certificates
+// are only requested if a client CA is configured.
+func headTLSConfig(c TLSConfiguration) (*tls.Config, error) {
+	if c.KeyFile == "" {
+		return nil, errors.New("tls.key_file is required when tls.cert_file is set")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.ClientCAFile == "" {
+		if c.RequireClientCert {
+			return nil, errors.New("tls.require_client_cert needs tls.client_ca_file")
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+
+	tlsConfig.ClientCAs = pool
+	// admin clients usually come without certificate, so only insist on one if asked to
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// certificateIdentities returns the common name and SANs of the verified
+// client certificate of r.
+func certificateIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	var identities []string
+
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	return identities
+}
+
+// satelliteCertificateMatches reports whether the verified client certificate
+// of r names the satellite, either by its name or one of its CertificateNames.
+func satelliteCertificateMatches(r *http.Request, satellite Satellite) bool {
+	names := append([]string{satellite.Name}, satellite.CertificateNames...)
+
+	for _, identity := range certificateIdentities(r) {
+		for _, name := range names {
+			if strings.EqualFold(identity, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SatelliteTLSOptions configures how a satellite verifies the head and which
+// client certificate it presents.
+type SatelliteTLSOptions struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	Pins               []string
+	CertFile           string
+	KeyFile            string
+}
+
+// satelliteTLSConfig builds the client side TLS configuration shared by all
+// requests a satellite sends to the head. Pins are checked even if certificate
+// verification is disabled, which allows pinning self-signed heads.
+func satelliteTLSConfig(o SatelliteTLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if len(o.Pins) > 0 {
+		pins := o.Pins
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("head presented no certificate")
+			}
+			pin := publicKeyPin(cs.PeerCertificates[0])
+			for _, p := range pins {
+				if p == pin {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate of head does not match any pin (got %s)", pin)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// publicKeyPin returns the base64 encoded SHA-256 hash of the certificate's
+// public key, the same format HPKP and curl's --pinnedpubkey use.
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
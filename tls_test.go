@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSatelliteTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := publicKeyPin(server.Certificate())
+
+	tests := []struct {
+		name        string
+		options     SatelliteTLSOptions
+		expectError bool
+	}{
+		{"unknown CA", SatelliteTLSOptions{}, true},
+		{"insecure", SatelliteTLSOptions{InsecureSkipVerify: true}, false},
+		{"private CA", SatelliteTLSOptions{CAFile: caFile}, false},
+		{"private CA with pin", SatelliteTLSOptions{CAFile: caFile, Pins: []string{"other", pin}}, false},
+		{"private CA with wrong pin", SatelliteTLSOptions{CAFile: caFile, Pins: []string{"other"}}, true},
+		{"insecure with wrong pin", SatelliteTLSOptions{InsecureSkipVerify: true, Pins: []string{"other"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := satelliteTLSConfig(tt.options)
+			if err != nil {
+				t.Fatalf("satelliteTLSConfig failed: %v", err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			res, err := client.Get(server.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+
+			if tt.expectError && err == nil {
+				t.Errorf("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Scopes an API token can be granted.
+const (
+	// ScopeReadOnly allows reading the configuration
+	ScopeReadOnly = "read-only"
+	// ScopeSatelliteAdmin allows creating, changing and deleting satellites
+	ScopeSatelliteAdmin = "satellite-admin"
+	// ScopeTargetAdmin allows creating, changing and deleting targets
+	ScopeTargetAdmin = "target-admin"
+	// ScopeConfigAdmin allows replacing and reloading the configuration and managing API tokens
+	ScopeConfigAdmin = "config-admin"
+)
+
+var validScopes = []string{ScopeReadOnly, ScopeSatelliteAdmin, ScopeTargetAdmin, ScopeConfigAdmin}
+
+// legacyCallerName identifies requests authorized by Configuration.Authorization.
+const legacyCallerName = "authorization"
+
+// APIToken is a named token for the admin API, restricted to a set of scopes.
+// Only a hash of the token is stored.
+type APIToken struct {
+	Name      string   `mapstructure:"name"`
+	Hash      string   `mapstructure:"hash" json:"-"`
+	Scopes    []string `mapstructure:"scopes"`
+	CreatedAt int64    `mapstructure:"created_at"`
+	// LastUsed is updated in memory and persisted with the next config write
+	LastUsed int64 `mapstructure:"last_used,omitempty"`
+}
+
+type TokenCreateResponsePacket struct {
+	Name   string   `mapstructure:"name"`
+	Token  string   `mapstructure:"token"`
+	Scopes []string `mapstructure:"scopes"`
+}
+
+// Caller is the authenticated identity of an admin API request.
+type Caller struct {
+	Name   string
+	Scopes []string
+}
+
+// HasScope reports whether the caller was granted scope. Every scope includes
+// read-only access.
+func (c *Caller) HasScope(scope string) bool {
+	if c == nil {
+		return false
+	}
+	if scope == ScopeReadOnly && len(c.Scopes) > 0 {
+		return true
+	}
+	return slices.Contains(c.Scopes, scope)
+}
+
+type contextKey string
+
+const callerContextKey contextKey = "caller"
+
+// callerFromContext returns the caller stored by authMiddleware.
+func callerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerContextKey).(*Caller)
+	return caller
+}
+
+// ValidateScopes checks that scopes is not empty and only holds known scopes.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(validScopes, scope) {
+			return fmt.Errorf("unknown scope %q - valid scopes are %s", scope, strings.Join(validScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// identifyCaller matches the authorization header of r against the legacy
+// authorization and the API tokens. Tokens have the form "<name>:<secret>".
+// It returns nil if the request is not authorized.
+func identifyCaller(r *http.Request) *Caller {
+	header := r.Header.Get(HeaderAuthorization)
+
+	cMutex.RLock()
+	configAuth := Config.Authorization
+	noTokens := len(Config.Tokens) == 0
+	cMutex.RUnlock()
+
+	// without any credentials configured the head runs open, see parseConfig
+	if (configAuth != "" || noTokens) && SecureCompareStrings(header, configAuth) {
+		return &Caller{Name: legacyCallerName, Scopes: validScopes}
+	}
+
+	name, secret, found := strings.Cut(header, ":")
+	if !found {
+		return nil
+	}
+
+	cMutex.RLock()
+	token, exists := Config.Tokens[name]
+	cMutex.RUnlock()
+
+	if !exists || !VerifySecret(secret, token.Hash) {
+		return nil
+	}
+
+	cMutex.Lock()
+	if t, exists := Config.Tokens[name]; exists {
+		t.LastUsed = time.Now().Unix()
+		Config.Tokens[name] = t
+	}
+	cMutex.Unlock()
+
+	return &Caller{Name: name, Scopes: token.Scopes}
+}
+
+// requireScope rejects requests whose caller lacks scope. It has to run after
+// authMiddleware.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller := callerFromContext(r.Context())
+			if !caller.HasScope(scope) {
+				handleError(w, http.StatusForbidden, r.RequestURI, "You're not allowed here",
+					fmt.Errorf("scope %s required", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ListTokens(w http.ResponseWriter, r *http.Request) {
+	cMutex.RLock()
+	tokens := make([]APIToken, 0, len(Config.Tokens))
+	for _, t := range Config.Tokens {
+		tokens = append(tokens, t)
+	}
+	cMutex.RUnlock()
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+
+	err := json.NewEncoder(w).Encode(tokens)
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	// CreateToken is behind authMiddleware
+	tokenName := chi.URLParam(r, "name")
+
+	// Validate token name
+	if err := ValidateIdentifier(tokenName, "token name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid token name", err)
+		return
+	}
+
+	var tokenStruct APIToken
+	if err := json.NewDecoder(r.Body).Decode(&tokenStruct); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Failure parsing request. Token not added.", err)
+		return
+	}
+
+	if err := ValidateScopes(tokenStruct.Scopes); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid scopes", err)
+		return
+	}
+
+	secret := RandomString(32)
+	hash, err := HashSecret(secret)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure hashing token. Token not added.", err)
+		return
+	}
+
+	token := APIToken{
+		Name:      tokenName,
+		Hash:      hash,
+		Scopes:    tokenStruct.Scopes,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	cMutex.Lock()
+	if _, found := Config.Tokens[tokenName]; found {
+		cMutex.Unlock()
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Token already exists", nil)
+		return
+	}
+
+	if Config.Tokens == nil {
+		Config.Tokens = make(map[string]APIToken)
+	}
+	Config.Tokens[tokenName] = token
+
+	err = WriteConfig()
+	if err != nil {
+		delete(Config.Tokens, tokenName)
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Token not added.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "token.create", "tokens/"+tokenName, nil, token)
+
+	log.WithFields(logrus.Fields{
+		"token":  tokenName,
+		"scopes": token.Scopes,
+		"by":     callerFromContext(r.Context()).Name,
+	}).Info("API token created")
+
+	err = json.NewEncoder(w).Encode(TokenCreateResponsePacket{
+		Name:   tokenName,
+		Token:  tokenName + ":" + secret,
+		Scopes: token.Scopes,
+	})
+
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Error()
+	}
+}
+
+func DeleteToken(w http.ResponseWriter, r *http.Request) {
+	// DeleteToken is behind authMiddleware
+	tokenName := chi.URLParam(r, "name")
+
+	// Validate token name
+	if err := ValidateIdentifier(tokenName, "token name"); err != nil {
+		handleError(w, http.StatusBadRequest, r.RequestURI, "Invalid token name", err)
+		return
+	}
+
+	cMutex.Lock()
+	token, found := Config.Tokens[tokenName]
+	if !found {
+		cMutex.Unlock()
+		handleError(w, http.StatusNotFound, r.RequestURI, "Token not found", nil)
+		return
+	}
+
+	delete(Config.Tokens, tokenName)
+	err := WriteConfig()
+
+	if err != nil {
+		Config.Tokens[tokenName] = token
+		cMutex.Unlock()
+		handleError(w, http.StatusInternalServerError, r.RequestURI, "Failure persisting config. Token not revoked.", nil)
+		return
+	}
+	cMutex.Unlock()
+
+	recordAudit(r, auditActor(r), "token.delete", "tokens/"+tokenName, token, nil)
+
+	log.WithFields(logrus.Fields{
+		"token": tokenName,
+		"by":    callerFromContext(r.Context()).Name,
+	}).Info("API token revoked")
+}
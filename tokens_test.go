@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddlewareScopes(t *testing.T) {
+	readerHash, _ := HashSecret("reader-secret")
+	satAdminHash, _ := HashSecret("satadmin-secret")
+	targetAdminHash, _ := HashSecret("targetadmin-secret")
+
+	cMutex.Lock()
+	Config = Configuration{
+		Authorization: "legacy-secret",
+		Tokens: map[string]APIToken{
+			"reader":      {Name: "reader", Hash: readerHash, Scopes: []string{ScopeReadOnly}},
+			"satadmin":    {Name: "satadmin", Hash: satAdminHash, Scopes: []string{ScopeSatelliteAdmin}},
+			"targetadmin": {Name: "targetadmin", Hash: targetAdminHash, Scopes: []string{ScopeTargetAdmin}},
+		},
+	}
+	cMutex.Unlock()
+
+	tests := []struct {
+		name     string
+		header   string
+		scope    string
+		expected int
+	}{
+		{"legacy read", "legacy-secret", ScopeReadOnly, http.StatusOK},
+		{"legacy config admin", "legacy-secret", ScopeConfigAdmin, http.StatusOK},
+		{"reader read", "reader:reader-secret", ScopeReadOnly, http.StatusOK},
+		{"reader satellite admin", "reader:reader-secret", ScopeSatelliteAdmin, http.StatusForbidden},
+		{"satadmin satellite admin", "satadmin:satadmin-secret", ScopeSatelliteAdmin, http.StatusOK},
+		{"satadmin read", "satadmin:satadmin-secret", ScopeReadOnly, http.StatusOK},
+		{"satadmin config admin", "satadmin:satadmin-secret", ScopeConfigAdmin, http.StatusForbidden},
+		{"satadmin target admin", "satadmin:satadmin-secret", ScopeTargetAdmin, http.StatusForbidden},
+		{"targetadmin target admin", "targetadmin:targetadmin-secret", ScopeTargetAdmin, http.StatusOK},
+		{"targetadmin satellite admin", "targetadmin:targetadmin-secret", ScopeSatelliteAdmin, http.StatusForbidden},
+		{"wrong token secret", "reader:satadmin-secret", ScopeReadOnly, http.StatusForbidden},
+		{"unknown token", "nobody:reader-secret", ScopeReadOnly, http.StatusForbidden},
+		{"no header", "", ScopeReadOnly, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authMiddleware(requireScope(tt.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+			r := httptest.NewRequest("GET", "/config", nil)
+			if tt.header != "" {
+				r.Header.Set(HeaderAuthorization, tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.expected {
+				t.Errorf("status = %d, want %d", w.Code, tt.expected)
+			}
+		})
+	}
+
+	if Config.Tokens["reader"].LastUsed == 0 {
+		t.Errorf("last used of token not tracked")
+	}
+
+	// a reloaded configuration keeps when the token was last used
+	c := Configuration{Tokens: map[string]APIToken{"reader": {Name: "reader", Hash: Config.Tokens["reader"].Hash}}}
+	keepRuntimeState(&c, Config)
+	if c.Tokens["reader"].LastUsed != Config.Tokens["reader"].LastUsed {
+		t.Errorf("last used of token lost on reload")
+	}
+}
+
+func TestAuthMiddlewareEmptyAuthorization(t *testing.T) {
+	readerHash, _ := HashSecret("reader-secret")
+
+	tests := []struct {
+		name     string
+		tokens   map[string]APIToken
+		expected int
+	}{
+		{"no credentials configured", nil, http.StatusOK},
+		{"only tokens configured", map[string]APIToken{
+			"reader": {Name: "reader", Hash: readerHash, Scopes: []string{ScopeReadOnly}},
+		}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cMutex.Lock()
+			Config = Configuration{Tokens: tt.tokens}
+			cMutex.Unlock()
+
+			handler := authMiddleware(requireScope(ScopeConfigAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("PUT", "/config", nil))
+
+			if w.Code != tt.expected {
+				t.Errorf("status = %d, want %d", w.Code, tt.expected)
+			}
+		})
+	}
+}
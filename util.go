@@ -1,19 +1,26 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/subtle"
 	"errors"
-	"math/rand"
+	"math/big"
 	"regexp"
-	"time"
+	"strings"
 )
 
+// RandomString returns a random alphanumeric string from a cryptographically
+// secure source, suitable for secrets.
 func RandomString(length int) string {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	max := big.NewInt(int64(len(chars)))
 	result := make([]byte, length)
 	for i := 0; i < length; i++ {
-		result[i] = chars[r.Intn(len(chars))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		result[i] = chars[n.Int64()]
 	}
 	return string(result)
 }
@@ -50,3 +57,14 @@ func SecureCompareStrings(a, b string) bool {
 	// subtle.ConstantTimeCompare returns 1 if equal, 0 if not equal
 	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
+
+// splitList splits a comma separated list and drops empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// validateCommand implements "nprobe validate". It checks a config file like
+// the head does on startup, without starting the head, and reports all
+// problems found. It returns the exit code.
+func validateCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", "config/config.json", "config file")
+	printSchema := flags.Bool("schema", false, "print the JSON Schema of the config file and exit")
+	skipReferences := flags.Bool("skip-references", false, "don't resolve ${ENV} and file: references, e.g. in CI without access to the secrets")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *printSchema {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(configSchema()); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	problems, err := validateConfigFile(*configFile, !*skipReferences)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(stderr, "%s: %s\n", *configFile, p)
+		}
+		fmt.Fprintf(stderr, "%s: %d problem(s) found\n", *configFile, len(problems))
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: ok\n", *configFile)
+	return 0
+}
+
+// validateConfigFile returns the problems found in a config file. err is set
+// if the file can't be read or parsed at all.
+func validateConfigFile(file string, resolveReferences bool) (problems []string, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigType(configType(file))
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	for _, key := range unknownKeys("", v.AllSettings(), configSchema()) {
+		problems = append(problems, key+": unknown setting")
+	}
+
+	if resolveReferences {
+		var errs ConfigErrors
+		if _, err := interpolateConfig(v, resolveReference); errors.As(err, &errs) {
+			for _, e := range errs {
+				problems = append(problems, e.Error())
+			}
+			return problems, nil
+		}
+	}
+
+	var c Configuration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	normalizeConfig(&c)
+
+	for _, e := range validateConfig(&c) {
+		problems = append(problems, e.Error())
+	}
+
+	token := c.Database.Token
+	if envToken := os.Getenv("INFLUXDB_TOKEN"); envToken != "" {
+		token = envToken
+	}
+	if resolveReferences || !(strings.Contains(token, "${") || strings.HasPrefix(token, fileReferencePrefix)) {
+		if err := ValidateInfluxToken(token); err != nil {
+			problems = append(problems, "database.token: "+err.Error())
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(t *testing.T) {
+	t.Setenv("INFLUXDB_TOKEN", "")
+
+	tests := []struct {
+		name     string
+		file     string
+		config   string
+		args     []string
+		code     int
+		expected []string
+	}{
+		{"valid", "config.json", testConfig, nil, 0, nil},
+		{"valid yaml", "config.yaml", "satellites:\n  sat1:\n    targets: [server1]\ntargets:\n  server1:\n    host: foo\n", nil, 0, nil},
+		{"typo in key", "config.json", `{"satellites": {"sat1": {"activ": true}}, "_comment": "ignored"}`, nil, 1, []string{"satellites.sat1.activ: unknown setting"}},
+		{"invalid", "config.json", `{"satellites": {"sat1": {"targets": ["server2"]}}, "database": {"token": "short"}}`, nil, 1, []string{"satellites.sat1.targets", "database.token"}},
+		{"missing env", "config.json", `{"authorization": "${NPROBE_TEST_UNSET}"}`, nil, 1, []string{"authorization: environment variable NPROBE_TEST_UNSET is not set"}},
+		{"skip references", "config.json", `{"authorization": "${NPROBE_TEST_UNSET}", "database": {"token": "${NPROBE_TEST_UNSET}"}}`, []string{"-skip-references"}, 0, nil},
+		{"malformed", "config.json", `{"satellites": `, nil, 1, []string{"config.json: "}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := validateCommand(append([]string{"-config", file}, tt.args...), &stdout, &stderr)
+
+			if code != tt.code {
+				t.Errorf("exit code = %d, want %d: %s", code, tt.code, stderr.String())
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(stderr.String(), e) {
+					t.Errorf("output misses %q: %s", e, stderr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestValidateExampleConfig(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := validateCommand([]string{"-config", "config/config.json.example", "-skip-references"}, &stdout, &stderr); code != 0 {
+		t.Errorf("example config invalid: %s", stderr.String())
+	}
+}
+
+func TestConfigSchemaUpToDate(t *testing.T) {
+	committed, err := os.ReadFile("config/config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	validateCommand([]string{"-schema"}, &stdout, &stderr)
+
+	if !bytes.Equal(committed, stdout.Bytes()) {
+		t.Errorf("config/config.schema.json is outdated, regenerate it with: nprobe validate -schema > config/config.schema.json")
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(committed, &schema); err != nil {
+		t.Errorf("schema is not valid JSON: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// configReloadDelay collects the events of one edit (editors often write a
+// file in several steps) into a single reload.
+const configReloadDelay = 500 * time.Millisecond
+
+// watchConfig reloads the config file when it changes on disk or the head
+// receives SIGHUP. The directory is watched rather than the file, editors
+// tend to replace files instead of writing to them. Watching stops when ctx
+// is done.
+func watchConfig(ctx context.Context) {
+	triggers := make(chan string, 16)
+	trigger := func(source string) {
+		select {
+		case triggers <- source:
+		default:
+		}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-hangup:
+				trigger("sighup")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(ConfigFile))
+	}
+	if err != nil {
+		if watcher != nil {
+			watcher.Close()
+		}
+		log.WithFields(logrus.Fields{"error": err}).Warn("Not watching config file, reload with SIGHUP or POST /config")
+	} else {
+		go func() {
+			defer watcher.Close()
+			configFile := filepath.Clean(ConfigFile)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event, ok := <-watcher.Events:
+					if !ok {
+						return
+					}
+					if filepath.Clean(event.Name) == configFile && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+						trigger("file")
+					}
+				case err, ok := <-watcher.Errors:
+					if !ok {
+						return
+					}
+					log.WithFields(logrus.Fields{"error": err}).Warn("Error while watching config file")
+				}
+			}
+		}()
+	}
+
+	// reload once no trigger arrived for configReloadDelay
+	go func() {
+		var source string
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case source = <-triggers:
+				settled = time.After(configReloadDelay)
+			case <-settled:
+				settled = nil
+				reloadFromDisk(source)
+			}
+		}
+	}()
+}
+
+// reloadFromDisk reloads the config file outside of a request, source names
+// what triggered it in the log and the audit log.
+func reloadFromDisk(source string) {
+	before, after, changed, err := reloadConfig()
+	if err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			for _, err := range errs {
+				log.WithFields(logrus.Fields{"setting": err.Path, "error": err.Err}).Error("Configuration invalid.")
+			}
+		}
+		log.WithFields(logrus.Fields{"trigger": source, "error": err}).Error("Config not reloaded, keeping running config")
+		return
+	}
+
+	if !changed {
+		log.WithFields(logrus.Fields{"trigger": source}).Debug("Config file unchanged")
+		return
+	}
+
+	log.WithFields(logrus.Fields{"trigger": source, "version": after.Version}).Info("Config reloaded")
+
+	writeAudit(AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    source,
+		Action:   "config.reload",
+		Resource: "config",
+		Changes:  diffConfig(before, after),
+	})
+}
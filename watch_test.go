@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { ConfigFile = "" })
+
+	write := func(targets string) {
+		config := `{"audit_log": "` + filepath.Join(dir, "audit.log") + `", "targets": {` + targets + `}}`
+		if err := os.WriteFile(ConfigFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasTarget := func(name string) bool {
+		cMutex.RLock()
+		defer cMutex.RUnlock()
+		_, found := Config.Targets[name]
+		return found
+	}
+
+	write(`"server1": {"host": "foo.example.com"}`)
+	cMutex.Lock()
+	Config = Configuration{}
+	configFileFingerprint = ""
+	cMutex.Unlock()
+	if _, _, _, err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchConfig(ctx)
+
+	write(`"server1": {"host": "foo.example.com"}, "server2": {"host": "bar.example.com"}`)
+	for deadline := time.Now().Add(5 * time.Second); !hasTarget("server2") && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !hasTarget("server2") {
+		t.Fatalf("changed config file not reloaded")
+	}
+
+	// once ctx is done changes are no longer picked up
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	write(`"server3": {"host": "baz.example.com"}`)
+	time.Sleep(2 * configReloadDelay)
+	if hasTarget("server3") {
+		t.Errorf("config file reloaded after ctx was done")
+	}
+}